@@ -5,40 +5,86 @@ import (
 	"flag"
 	"io/ioutil"
 	"log"
+	"runtime"
+	"strings"
 )
 
 type config struct {
-	BilderDir          string `json:"bilder-dir"`
-	URLPathPrefix      string `json:"url-path-prefix"`
-	AccessLog          string `json:"access-log"`
-	Addr               string `json:"addr"`
-	ReloadDelaySeconds int    `json:"reload-delay-seconds"`
+	BilderDir          string   `json:"bilder-dir"`
+	URLPathPrefix      string   `json:"url-path-prefix"`
+	PublicURL          string   `json:"public-url"`
+	AccessLog          string   `json:"access-log"`
+	Addr               string   `json:"addr"`
+	ReloadDelaySeconds int      `json:"reload-delay-seconds"`
+	ThumbWorkers       int      `json:"thumb-workers"`
+	DisplaySizes       []int    `json:"display-sizes"`
+	ResizeSizes        []string `json:"resize-sizes"`
+	ResizeCacheMB      int      `json:"resize-cache-mb"`
+	DebugVars          bool     `json:"debug-vars"`
+	FFmpeg             string   `json:"ffmpeg"`
+	CacheDir           string   `json:"cache-dir"`
+	Overview           bool     `json:"overview"`
+	GCDryRun           bool     `json:"gc-dry-run"`
+
+	Thumbs thumbSettings `json:"thumbs"`
+
+	SessionFile             string `json:"session-file"`
+	SessionIdleTimeoutHours int    `json:"session-idle-timeout-hours"`
+	SessionMaxAgeHours      int    `json:"session-max-age-hours"`
+	SecureCookies           bool   `json:"secure-cookies"`
+	LoginForm               bool   `json:"login-form"`
+	Secret                  string `json:"secret"`
+
+	LoginAttempts       int      `json:"login-attempts"`
+	LoginAlbumAttempts  int      `json:"login-album-attempts"`
+	LoginLockoutSeconds int      `json:"login-lockout-seconds"`
+	TrustedProxies      []string `json:"trusted-proxies"`
 }
 
 var defaultConfig = config{
 	BilderDir:          "bilder",
 	Addr:               "0.0.0.0:8173",
-	ReloadDelaySeconds: 10,
+	ReloadDelaySeconds: 60,
+	ThumbWorkers:       runtime.NumCPU(),
+	DisplaySizes:       []int{1600, 2560},
+	ResizeCacheMB:      256,
+
+	SessionIdleTimeoutHours: 7 * 24,
+	SessionMaxAgeHours:      30 * 24,
+
+	LoginAttempts:       5,
+	LoginAlbumAttempts:  50,
+	LoginLockoutSeconds: 60,
 }
 
 func mustParseConfig() config {
 	f := flag.String("config", "", "JSON config file for bilder.")
 	flag.Parse()
+	return mustReadConfig(*f)
+}
 
-	if *f == "" {
+func mustReadConfig(f string) config {
+	if f == "" {
 		return defaultConfig
 	}
 
-	byts, err := ioutil.ReadFile(*f)
+	byts, err := ioutil.ReadFile(f)
 	if err != nil {
-		log.Fatalf("Failed to read config file %#v err=%v", *f, err)
+		log.Fatalf("Failed to read config file %#v err=%v", f, err)
 	}
 
 	var c config
 	if err := json.Unmarshal(byts, &c); err != nil {
-		log.Fatalf("Failed to unmarshal contents of %#v as config, err=%v", *f, err)
+		log.Fatalf("Failed to unmarshal contents of %#v as config, err=%v", f, err)
 	}
 
+	return c.withDefaults()
+}
+
+// withDefaults returns c with the defaults of the options that aren't set.
+func (c config) withDefaults() config {
+	c.PublicURL = strings.TrimSuffix(c.PublicURL, "/")
+
 	if c.BilderDir == "" {
 		c.BilderDir = defaultConfig.BilderDir
 	}
@@ -51,5 +97,38 @@ func mustParseConfig() config {
 		c.ReloadDelaySeconds = defaultConfig.ReloadDelaySeconds
 	}
 
+	if c.ThumbWorkers <= 0 {
+		c.ThumbWorkers = defaultConfig.ThumbWorkers
+	}
+
+	if c.ResizeCacheMB <= 0 {
+		c.ResizeCacheMB = defaultConfig.ResizeCacheMB
+	}
+
+	// an empty list disables display renditions
+	if c.DisplaySizes == nil {
+		c.DisplaySizes = defaultConfig.DisplaySizes
+	}
+
+	if c.SessionIdleTimeoutHours <= 0 {
+		c.SessionIdleTimeoutHours = defaultConfig.SessionIdleTimeoutHours
+	}
+
+	if c.SessionMaxAgeHours <= 0 {
+		c.SessionMaxAgeHours = defaultConfig.SessionMaxAgeHours
+	}
+
+	if c.LoginAttempts <= 0 {
+		c.LoginAttempts = defaultConfig.LoginAttempts
+	}
+
+	if c.LoginAlbumAttempts <= 0 {
+		c.LoginAlbumAttempts = defaultConfig.LoginAlbumAttempts
+	}
+
+	if c.LoginLockoutSeconds <= 0 {
+		c.LoginLockoutSeconds = defaultConfig.LoginLockoutSeconds
+	}
+
 	return c
 }
@@ -0,0 +1,216 @@
+package main
+
+import (
+	"fmt"
+	"image"
+	"io"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/rwcarlsen/goexif/exif"
+	"github.com/rwcarlsen/goexif/tiff"
+)
+
+// exifDetails holds the camera settings of an image as far as they are
+// available in its EXIF data.
+type exifDetails struct {
+	Make         string
+	Model        string
+	Lens         string
+	FocalLength  float64
+	FNumber      float64
+	ExposureTime string
+	ISO          int
+	Taken        time.Time
+}
+
+func (e exifDetails) Camera() string {
+	if strings.HasPrefix(strings.ToLower(e.Model), strings.ToLower(e.Make)) {
+		return e.Model
+	}
+	return strings.TrimSpace(e.Make + " " + e.Model)
+}
+
+func (e exifDetails) Focal() string {
+	if e.FocalLength <= 0 {
+		return ""
+	}
+	return fmt.Sprintf("%gmm", e.FocalLength)
+}
+
+func (e exifDetails) Aperture() string {
+	if e.FNumber <= 0 {
+		return ""
+	}
+	return fmt.Sprintf("f/%g", e.FNumber)
+}
+
+func (e exifDetails) Shutter() string {
+	if e.ExposureTime == "" {
+		return ""
+	}
+	return e.ExposureTime + "s"
+}
+
+func (e exifDetails) Empty() bool {
+	return e == exifDetails{}
+}
+
+func exifString(x *exif.Exif, n exif.FieldName) string {
+	tag, err := x.Get(n)
+	if err != nil || tag.Format() != tiff.StringVal {
+		return ""
+	}
+	s, err := tag.StringVal()
+	if err != nil {
+		return ""
+	}
+	return strings.TrimSpace(strings.Trim(s, "\x00"))
+}
+
+func exifFloat(x *exif.Exif, n exif.FieldName) float64 {
+	tag, err := x.Get(n)
+	if err != nil {
+		return 0
+	}
+	num, den, err := tag.Rat2(0)
+	if err != nil || den == 0 {
+		return 0
+	}
+	return float64(num) / float64(den)
+}
+
+// exifExposure formats the exposure time as a fraction for exposures
+// shorter than a second, e.g. 1/250.
+func exifExposure(x *exif.Exif) string {
+	tag, err := x.Get(exif.ExposureTime)
+	if err != nil {
+		return ""
+	}
+	num, den, err := tag.Rat2(0)
+	if err != nil || num <= 0 || den <= 0 {
+		return ""
+	}
+	if num >= den {
+		return fmt.Sprintf("%g", float64(num)/float64(den))
+	}
+	return fmt.Sprintf("1/%.0f", float64(den)/float64(num))
+}
+
+func exifOrientation(x *exif.Exif) int {
+	tag, err := x.Get(exif.Orientation)
+	if err != nil {
+		return 1
+	}
+
+	o, err := tag.Int(0)
+	if err != nil || o < 1 || o > 8 {
+		return 1
+	}
+	return o
+}
+
+func readExifDetails(x *exif.Exif) exifDetails {
+	e := exifDetails{
+		Make:         exifString(x, exif.Make),
+		Model:        exifString(x, exif.Model),
+		Lens:         exifString(x, exif.LensModel),
+		FocalLength:  exifFloat(x, exif.FocalLength),
+		FNumber:      exifFloat(x, exif.FNumber),
+		ExposureTime: exifExposure(x),
+	}
+
+	if tag, err := x.Get(exif.ISOSpeedRatings); err == nil {
+		e.ISO, _ = tag.Int(0)
+	}
+
+	if t, err := x.DateTime(); err == nil {
+		e.Taken = t
+	}
+
+	return e
+}
+
+// readOrientation returns the EXIF orientation of the image in r, 1 if it
+// has none.
+func readOrientation(r io.Reader) int {
+	x, err := exif.Decode(r)
+	if err != nil {
+		return 1
+	}
+	return exifOrientation(x)
+}
+
+// orientedSize returns the dimensions of a w by h image when displayed with
+// EXIF orientation o.
+func orientedSize(w, h, o int) (int, int) {
+	if o >= 5 && o <= 8 {
+		return h, w
+	}
+	return w, h
+}
+
+// orient rotates and flips img so that it displays upright given its EXIF
+// orientation o.
+func orient(img image.Image, o int) image.Image {
+	if o < 2 || o > 8 {
+		return img
+	}
+
+	b := img.Bounds()
+	w, h := b.Dx(), b.Dy()
+	dw, dh := orientedSize(w, h, o)
+	dst := image.NewRGBA(image.Rect(0, 0, dw, dh))
+	for y := 0; y < h; y++ {
+		for x := 0; x < w; x++ {
+			var dx, dy int
+			switch o {
+			case 2:
+				dx, dy = w-1-x, y
+			case 3:
+				dx, dy = w-1-x, h-1-y
+			case 4:
+				dx, dy = x, h-1-y
+			case 5:
+				dx, dy = y, x
+			case 6:
+				dx, dy = h-1-y, x
+			case 7:
+				dx, dy = h-1-y, w-1-x
+			case 8:
+				dx, dy = y, w-1-x
+			}
+			dst.Set(dx, dy, img.At(b.Min.X+x, b.Min.Y+y))
+		}
+	}
+	return dst
+}
+
+// readImageDetails determines the displayed dimensions and EXIF details of
+// the image at p.
+func readImageDetails(p string) (indexEntry, error) {
+	var e indexEntry
+	fh, err := os.Open(p)
+	if err != nil {
+		return e, err
+	}
+	defer fh.Close()
+
+	conf, _, err := image.DecodeConfig(fh)
+	if err != nil {
+		return e, err
+	}
+
+	if _, err := fh.Seek(0, 0); err != nil {
+		return e, err
+	}
+
+	e.Orientation = 1
+	if x, err := exif.Decode(fh); err == nil {
+		e.Orientation = exifOrientation(x)
+		e.Exif = readExifDetails(x)
+	}
+	e.Width, e.Height = orientedSize(conf.Width, conf.Height, e.Orientation)
+	return e, nil
+}
@@ -0,0 +1,49 @@
+package main
+
+import (
+	"image"
+	"image/color"
+	"reflect"
+	"testing"
+)
+
+func TestOrient(t *testing.T) {
+	// a 3x2 image with pixels a to f, as gray values
+	a, b, c, d, e, f := uint8(10), uint8(20), uint8(30), uint8(40), uint8(50), uint8(60)
+	img := image.NewGray(image.Rect(0, 0, 3, 2))
+	copy(img.Pix, []uint8{a, b, c, d, e, f})
+
+	for _, tt := range []struct {
+		orientation int
+		expected    [][]uint8 // rows of the displayed image
+	}{
+		{0, [][]uint8{{a, b, c}, {d, e, f}}},
+		{1, [][]uint8{{a, b, c}, {d, e, f}}},
+		{2, [][]uint8{{c, b, a}, {f, e, d}}},
+		{3, [][]uint8{{f, e, d}, {c, b, a}}},
+		{4, [][]uint8{{d, e, f}, {a, b, c}}},
+		{5, [][]uint8{{a, d}, {b, e}, {c, f}}},
+		{6, [][]uint8{{d, a}, {e, b}, {f, c}}},
+		{7, [][]uint8{{f, c}, {e, b}, {d, a}}},
+		{8, [][]uint8{{c, f}, {b, e}, {a, d}}},
+		{9, [][]uint8{{a, b, c}, {d, e, f}}},
+	} {
+		o := orient(img, tt.orientation)
+		var actual [][]uint8
+		for y := o.Bounds().Min.Y; y < o.Bounds().Max.Y; y++ {
+			var row []uint8
+			for x := o.Bounds().Min.X; x < o.Bounds().Max.X; x++ {
+				row = append(row, color.GrayModel.Convert(o.At(x, y)).(color.Gray).Y)
+			}
+			actual = append(actual, row)
+		}
+		if !reflect.DeepEqual(tt.expected, actual) {
+			t.Errorf("Orientation %v: expected %v, got %v", tt.orientation, tt.expected, actual)
+		}
+
+		w, h := orientedSize(3, 2, tt.orientation)
+		if w != len(tt.expected[0]) || h != len(tt.expected) {
+			t.Errorf("Orientation %v: expected size %vx%v, got %vx%v", tt.orientation, len(tt.expected[0]), len(tt.expected), w, h)
+		}
+	}
+}
@@ -0,0 +1,188 @@
+package main
+
+import (
+	"flag"
+	"io/ioutil"
+	"log"
+	"os"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"time"
+)
+
+var (
+	// tempFileRegexp matches the temporary files that generated images are
+	// written to before they're renamed.
+	tempFileRegexp = regexp.MustCompile("^\\..+\\.tmp[0-9]*$")
+
+	// tempFileTTL is how old temporary files need to be before they're
+	// removed, so that images that are still being written are kept.
+	tempFileTTL = time.Hour
+)
+
+// pagesDirName is the directory in the cache directory that earlier versions
+// of bilder wrote album pages to.
+const pagesDirName = "pages"
+
+// collector removes files that bilder generated but no longer needs, like
+// thumbs of removed images, temporary files of interrupted writes and pages
+// that earlier versions of bilder wrote to disk. In dry-run mode it only
+// logs the files it would remove, once per file.
+type collector struct {
+	dryRun   bool
+	count    int
+	reported map[string]bool
+}
+
+func newCollector(dryRun bool) *collector {
+	return &collector{dryRun: dryRun, reported: map[string]bool{}}
+}
+
+// remove removes the file or directory at p and reports whether it did.
+func (c *collector) remove(p, what string) bool {
+	if c.dryRun {
+		if !c.reported[p] {
+			log.Printf("Would remove %v %#v.", what, p)
+			c.reported[p] = true
+			c.count++
+		}
+		return false
+	}
+
+	if err := os.RemoveAll(p); err != nil {
+		log.Printf("Failed to remove %v %#v, err=%v", what, p, err)
+		return false
+	}
+	log.Printf("Removed %v %#v.", what, p)
+	c.count++
+	return true
+}
+
+func isStaleTempFile(f os.FileInfo) bool {
+	return !f.IsDir() && tempFileRegexp.MatchString(f.Name()) && time.Since(f.ModTime()) > tempFileTTL
+}
+
+// collectGarbage removes the generated files of album d that are no longer
+// needed given its images is, its files fs and the files rfs in its
+// rendition directory. Files in the album directory are only removed if
+// bilder recorded writing or adopting them, their names alone don't tell
+// them apart from photos.
+func (w *watcher) collectGarbage(d string, fs, rfs []os.FileInfo, is map[string]*imgDetails) {
+	ad, rd := w.layout.albumDir(d), w.layout.renditionDir(d)
+
+	// renditions that earlier versions stored in the album directory, like
+	// 2x thumbs, aren't kept there.
+	keep, akeep := map[string]bool{}, map[string]bool{}
+	for n, id := range is {
+		for rn, r := range w.renditionFiles(n) {
+			keep[rn] = true
+			akeep[rn] = w.renditionDir(d, r.kind) == ad
+		}
+		if id.poster != "" {
+			keep[filepath.Base(id.poster)] = true
+			akeep[filepath.Base(id.poster)] = true
+		}
+	}
+
+	for _, f := range fs {
+		switch {
+		case isStaleTempFile(f):
+			w.gc.remove(filepath.Join(ad, f.Name()), "temporary file")
+		case !akeep[f.Name()] && w.index.isGenerated(d, f):
+			if w.gc.remove(filepath.Join(ad, f.Name()), "orphaned thumb") {
+				w.index.forget(d, f.Name())
+			}
+		}
+	}
+
+	// the rendition directory only contains generated files, so anything
+	// that doesn't belong to a current image or video can go.
+	for _, f := range rfs {
+		switch {
+		case f.IsDir() || keep[f.Name()]:
+			continue
+		case tempFileRegexp.MatchString(f.Name()) && !isStaleTempFile(f):
+			continue
+		}
+		w.gc.remove(filepath.Join(rd, f.Name()), "orphaned thumb")
+	}
+}
+
+// collectRemovedAlbum removes the generated files of album d, which no
+// longer exists, from its rendition directory.
+func (w *watcher) collectRemovedAlbum(d string) {
+	rd := w.layout.renditionDir(d)
+	fs, err := ioutil.ReadDir(rd)
+	if err != nil {
+		return
+	}
+	for _, f := range fs {
+		if !f.IsDir() {
+			w.gc.remove(filepath.Join(rd, f.Name()), "orphaned thumb")
+		}
+	}
+	if !w.gc.dryRun {
+		os.Remove(rd) // only succeeds if there are no sub-albums left
+	}
+}
+
+// collectRemovedAlbums removes the generated files of albums that no longer
+// exist from the rendition directories, given the albums that were found.
+func (w *watcher) collectRemovedAlbums(found map[string]struct{}) {
+	root := w.layout.renditionDir("")
+	var ds []string
+	filepath.Walk(root, func(p string, fi os.FileInfo, err error) error {
+		if err != nil || !fi.IsDir() || p == root {
+			return nil
+		}
+		rel, err := filepath.Rel(root, p)
+		if err != nil {
+			return filepath.SkipDir
+		}
+		if _, ok := found[filepath.ToSlash(rel)]; !ok {
+			ds = append(ds, filepath.ToSlash(rel))
+		}
+		return nil
+	})
+
+	// sub-albums first, so that empty directories can be removed
+	sort.Slice(ds, func(i, j int) bool { return len(ds[i]) > len(ds[j]) })
+	for _, d := range ds {
+		w.collectRemovedAlbum(d)
+	}
+}
+
+// collectStalePages removes the album pages that earlier versions of bilder
+// wrote to the cache directory.
+func (w *watcher) collectStalePages() {
+	if w.layout.inPlace() {
+		return
+	}
+	pd := filepath.Join(w.layout.cacheDir, pagesDirName)
+	if _, err := os.Stat(pd); err == nil {
+		w.gc.remove(pd, "stale pages")
+	}
+}
+
+// gcCommand implements `bilder gc` which removes generated files that are
+// no longer needed once, rather than as part of serving albums.
+func gcCommand(args []string) {
+	fs := flag.NewFlagSet("gc", flag.ExitOnError)
+	cf := fs.String("config", "", "JSON config file for bilder.")
+	dryRun := fs.Bool("dry-run", false, "Only log the files that would be removed.")
+	fs.Parse(args)
+
+	c := mustReadConfig(*cf)
+	c.GCDryRun = c.GCDryRun || *dryRun
+
+	w := newWatcher(c, nil)
+	w.collectStalePages()
+	w.reloadContents()
+
+	if w.gc.dryRun {
+		log.Printf("Would remove %v files.", w.gc.count)
+		return
+	}
+	log.Printf("Removed %v files.", w.gc.count)
+}
@@ -1,12 +1,16 @@
 module github.com/fgeller/bilder
 
-go 1.14
+go 1.18
 
 require (
+	github.com/fsnotify/fsnotify v1.7.0
 	github.com/gorilla/handlers v1.4.2
 	github.com/nfnt/resize v0.0.0-20160109112512-4d93a29130b1
-	github.com/niemeyer/pretty v0.0.0-20200227124842-a10e7caefd8e // indirect
 	github.com/oliamb/cutter v0.2.2
-	github.com/satori/go.uuid v1.2.0
-	gopkg.in/check.v1 v1.0.0-20200227125254-8fa46927fb4f // indirect
+	github.com/rwcarlsen/goexif v0.0.0-20190401172101-9e8deecbddbd
+	golang.org/x/crypto v0.23.0
+	golang.org/x/image v0.18.0
+	golang.org/x/term v0.20.0
 )
+
+require golang.org/x/sys v0.20.0 // indirect
@@ -0,0 +1,277 @@
+package main
+
+import (
+	"encoding/gob"
+	"io/ioutil"
+	"log"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+)
+
+const (
+	indexFileName = ".bilder-index.gob"
+
+	// indexVersion needs to be incremented when indexEntry changes in a way
+	// that requires existing entries to be determined again.
+	indexVersion = 2
+)
+
+type indexFile struct {
+	Version int
+	Entries map[string]indexEntry
+
+	// Generated holds the files that bilder wrote to album directories by
+	// their album/name paths.
+	Generated map[string]fileStamp
+
+	// Checked holds the renditions that are known to be complete images by
+	// their album/name paths, so that they're not decoded on every start.
+	Checked map[string]fileStamp
+}
+
+// fileStamp identifies the contents of a file by its size and modification
+// time, a record no longer applies once either changes.
+type fileStamp struct {
+	Size    int64
+	ModTime time.Time
+}
+
+func stampOf(f os.FileInfo) fileStamp {
+	return fileStamp{Size: f.Size(), ModTime: f.ModTime()}
+}
+
+func (s fileStamp) matches(f os.FileInfo) bool {
+	return !f.IsDir() && s.Size == f.Size() && s.ModTime.Equal(f.ModTime())
+}
+
+// indexEntry holds the details of an image that are expensive to
+// determine, valid as long as the file's size and modification time match.
+type indexEntry struct {
+	Size    int64
+	ModTime time.Time
+	Width   int
+	Height  int
+
+	// Orientation is the image's EXIF orientation, Width and Height are
+	// already swapped accordingly.
+	Orientation int
+	Exif        exifDetails
+
+	// Poster is the path of the poster image that Width and Height were
+	// determined from for videos.
+	Poster string
+
+	// Thumbs is the key of the settings that the image's thumbs were
+	// generated with.
+	Thumbs string
+}
+
+// indexChanges lists the images, as album/name paths, that changed
+// between two scans.
+type indexChanges struct {
+	Added    []string
+	Modified []string
+	Removed  []string
+}
+
+func (c indexChanges) empty() bool {
+	return len(c.Added) == 0 && len(c.Modified) == 0 && len(c.Removed) == 0
+}
+
+func (c *indexChanges) merge(o indexChanges) {
+	c.Added = append(c.Added, o.Added...)
+	c.Modified = append(c.Modified, o.Modified...)
+	c.Removed = append(c.Removed, o.Removed...)
+}
+
+type imageIndex struct {
+	path      string
+	entries   map[string]indexEntry
+	generated map[string]fileStamp
+	checked   map[string]fileStamp
+	dirty     bool
+}
+
+func indexKey(d, n string) string {
+	return d + "/" + n
+}
+
+func loadIndex(p string) *imageIndex {
+	idx := &imageIndex{path: p, entries: map[string]indexEntry{}, generated: map[string]fileStamp{}, checked: map[string]fileStamp{}}
+	fh, err := os.Open(p)
+	if err != nil {
+		if !os.IsNotExist(err) {
+			log.Printf("Failed to open index %#v, err=%v", p, err)
+		}
+		return idx
+	}
+	defer fh.Close()
+
+	var f indexFile
+	if err := gob.NewDecoder(fh).Decode(&f); err != nil {
+		log.Printf("Failed to decode index %#v, starting with an empty index, err=%v", p, err)
+		return idx
+	}
+
+	if f.Version != indexVersion {
+		log.Printf("Ignoring index %#v with outdated version %v.", p, f.Version)
+		return idx
+	}
+	if f.Entries != nil {
+		idx.entries = f.Entries
+	}
+	if f.Generated != nil {
+		idx.generated = f.Generated
+	}
+	if f.Checked != nil {
+		idx.checked = f.Checked
+	}
+
+	log.Printf("Loaded %v entries from index %#v.", len(idx.entries), p)
+	return idx
+}
+
+// lookup returns the entry for image n in album d if it is still valid for
+// a file of the given size and modification time.
+func (idx *imageIndex) lookup(d, n string, size int64, mt time.Time) (indexEntry, bool) {
+	e, ok := idx.entries[indexKey(d, n)]
+	if !ok || e.Size != size || !e.ModTime.Equal(mt) {
+		return indexEntry{}, false
+	}
+	return e, true
+}
+
+func (idx *imageIndex) put(d, n string, e indexEntry) {
+	idx.entries[indexKey(d, n)] = e
+	idx.dirty = true
+}
+
+// prune removes the entries of album d that aren't in keep and returns
+// their keys. Entries of sub-albums of d are kept.
+func (idx *imageIndex) prune(d string, keep map[string]*imgDetails) []string {
+	var removed []string
+	prefix := d + "/"
+	for k := range idx.entries {
+		if !strings.HasPrefix(k, prefix) {
+			continue
+		}
+		n := k[len(prefix):]
+		if strings.Contains(n, "/") {
+			continue
+		}
+		if _, ok := keep[n]; ok {
+			continue
+		}
+		delete(idx.entries, k)
+		removed = append(removed, k)
+	}
+	if len(removed) > 0 {
+		idx.dirty = true
+	}
+	sort.Strings(removed)
+	return removed
+}
+
+// record notes that bilder wrote file f to album d.
+func (idx *imageIndex) record(d string, f os.FileInfo) {
+	idx.generated[indexKey(d, f.Name())] = stampOf(f)
+	idx.dirty = true
+}
+
+// isGenerated reports whether file f of album d was written by bilder
+// and hasn't changed since.
+func (idx *imageIndex) isGenerated(d string, f os.FileInfo) bool {
+	s, ok := idx.generated[indexKey(d, f.Name())]
+	return ok && s.matches(f)
+}
+
+// check notes that rendition f of album d is a complete image.
+func (idx *imageIndex) check(d string, f os.FileInfo) {
+	idx.checked[indexKey(d, f.Name())] = stampOf(f)
+	idx.dirty = true
+}
+
+// isChecked reports whether rendition f of album d is known to be a
+// complete image and hasn't changed since.
+func (idx *imageIndex) isChecked(d string, f os.FileInfo) bool {
+	s, ok := idx.checked[indexKey(d, f.Name())]
+	return ok && s.matches(f)
+}
+
+func (idx *imageIndex) forget(d, n string) {
+	delete(idx.generated, indexKey(d, n))
+	idx.dirty = true
+}
+
+// pruneGenerated forgets the generated files of album d that are no longer
+// among its files fs or that were changed since. Files of sub-albums of d
+// are kept.
+func (idx *imageIndex) pruneGenerated(d string, fs []os.FileInfo) {
+	idx.pruneStamps(idx.generated, d, fs)
+}
+
+// pruneChecked forgets the checked renditions of album d that are no longer
+// among its generated files fs or that were changed since.
+func (idx *imageIndex) pruneChecked(d string, fs []os.FileInfo) {
+	idx.pruneStamps(idx.checked, d, fs)
+}
+
+func (idx *imageIndex) pruneStamps(stamps map[string]fileStamp, d string, fs []os.FileInfo) {
+	current := map[string]bool{}
+	for _, f := range fs {
+		if s, ok := stamps[indexKey(d, f.Name())]; ok && s.matches(f) {
+			current[f.Name()] = true
+		}
+	}
+
+	prefix := d + "/"
+	for k := range stamps {
+		if !strings.HasPrefix(k, prefix) {
+			continue
+		}
+		n := k[len(prefix):]
+		if strings.Contains(n, "/") || current[n] {
+			continue
+		}
+		delete(stamps, k)
+		idx.dirty = true
+	}
+}
+
+func (idx *imageIndex) save() {
+	if !idx.dirty {
+		return
+	}
+
+	fh, err := ioutil.TempFile(filepath.Dir(idx.path), filepath.Base(idx.path)+".tmp")
+	if err != nil {
+		log.Printf("Failed to create temporary index file, err=%v", err)
+		return
+	}
+	tp := fh.Name()
+
+	f := indexFile{Version: indexVersion, Entries: idx.entries, Generated: idx.generated, Checked: idx.checked}
+	if err := gob.NewEncoder(fh).Encode(f); err != nil {
+		log.Printf("Failed to encode index, err=%v", err)
+		fh.Close()
+		os.Remove(tp)
+		return
+	}
+
+	if err := fh.Close(); err != nil {
+		log.Printf("Failed to write index %#v, err=%v", tp, err)
+		os.Remove(tp)
+		return
+	}
+
+	if err := os.Rename(tp, idx.path); err != nil {
+		log.Printf("Failed to replace index %#v, err=%v", idx.path, err)
+		os.Remove(tp)
+		return
+	}
+
+	idx.dirty = false
+}
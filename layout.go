@@ -0,0 +1,110 @@
+package main
+
+import (
+	"path/filepath"
+	"strings"
+)
+
+// thumbsPath is the path below an album's URL under which thumbs are served
+// when they are stored in the cache directory.
+const thumbsPath = "_thumbs"
+
+// thumbsDirName is the directory in the cache directory that holds the
+// thumbs of albums.
+const thumbsDirName = "thumbs"
+
+// renditionsDirName is the hidden directory in the bilder directory that
+// holds the renditions other than thumbs without a cache directory, so that
+// they can't collide with files in the album directories.
+const renditionsDirName = ".bilder-renditions"
+
+// layout determines where bilder stores the files it generates. Without a
+// cache directory, thumbs are stored in the album directories and other
+// renditions in a hidden directory. Albums are identified by their slash
+// separated path below the bilder directory.
+type layout struct {
+	dir      string
+	cacheDir string
+}
+
+func (l layout) inPlace() bool {
+	return l.cacheDir == ""
+}
+
+func (l layout) albumDir(d string) string {
+	return filepath.Join(l.dir, filepath.FromSlash(d))
+}
+
+func (l layout) thumbDir(d string) string {
+	if l.inPlace() {
+		return l.albumDir(d)
+	}
+	return filepath.Join(l.cacheDir, thumbsDirName, filepath.FromSlash(d))
+}
+
+// renditionDir returns the directory of the renditions of album d's images
+// other than thumbs.
+func (l layout) renditionDir(d string) string {
+	if l.inPlace() {
+		return filepath.Join(l.dir, renditionsDirName, filepath.FromSlash(d))
+	}
+	return l.thumbDir(d)
+}
+
+// renditionURL returns the URL path of rendition n of album d, which are
+// always served below thumbsPath.
+func (l layout) renditionURL(d, n string) string {
+	return strings.Join([]string{"b", d, thumbsPath, n}, "/")
+}
+
+func (l layout) thumbURL(d, n string) string {
+	if l.inPlace() {
+		return strings.Join([]string{"b", d, n}, "/")
+	}
+	return strings.Join([]string{"b", d, thumbsPath, n}, "/")
+}
+
+// filePath returns the path of the file that is served under URL path u of
+// album d, as returned by thumbURL for thumbs and renditionURL for other
+// renditions.
+func (l layout) filePath(d, u string) (string, bool) {
+	rel := strings.TrimPrefix(u, "b/"+d+"/")
+	if rel == u || rel == "" {
+		return "", false
+	}
+
+	for _, s := range strings.Split(rel, "/") {
+		if s == "" || strings.HasPrefix(s, ".") {
+			return "", false
+		}
+	}
+
+	if strings.HasPrefix(rel, thumbsPath+"/") {
+		return filepath.Join(l.renditionDir(d), filepath.FromSlash(strings.TrimPrefix(rel, thumbsPath+"/"))), true
+	}
+	return filepath.Join(l.albumDir(d), filepath.FromSlash(rel)), true
+}
+
+func (l layout) indexPath() string {
+	if l.inPlace() {
+		return filepath.Join(l.dir, indexFileName)
+	}
+	return filepath.Join(l.cacheDir, indexFileName)
+}
+
+// isCacheDir reports whether p is the cache directory, e.g. when it's
+// configured to be a sub-directory of the bilder directory.
+func (l layout) isCacheDir(p string) bool {
+	if l.inPlace() {
+		return false
+	}
+	ap, err := filepath.Abs(p)
+	if err != nil {
+		return false
+	}
+	ac, err := filepath.Abs(l.cacheDir)
+	if err != nil {
+		return false
+	}
+	return ap == ac
+}
@@ -0,0 +1,197 @@
+package main
+
+import (
+	"log"
+	"net"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	// maxLockout caps the exponential back-off of failed logins.
+	maxLockout = time.Hour
+
+	// failedLoginTTL is how long failed logins of a client are remembered
+	// after its last attempt.
+	failedLoginTTL = 2 * maxLockout
+)
+
+type failedLogins struct {
+	count       int
+	last        time.Time
+	lockedUntil time.Time
+}
+
+// loginLimiter tracks failed logins per client and album, and per album
+// across all clients, so that clients can't guess passwords by changing
+// their address. Clients are locked out for exponentially increasing
+// durations once they, or all clients of an album together, used up their
+// attempts.
+type loginLimiter struct {
+	sync.Mutex
+	attempts      int
+	albumAttempts int
+	lockout       time.Duration
+	trusted       []*net.IPNet
+	failed        map[string]*failedLogins
+	lastSweep     time.Time
+}
+
+func newLoginLimiter(c config) *loginLimiter {
+	l := &loginLimiter{
+		attempts:      c.LoginAttempts,
+		albumAttempts: c.LoginAlbumAttempts,
+		lockout:       time.Duration(c.LoginLockoutSeconds) * time.Second,
+		failed:        map[string]*failedLogins{},
+	}
+
+	for _, p := range c.TrustedProxies {
+		if !strings.Contains(p, "/") {
+			if ip := net.ParseIP(p); ip != nil && ip.To4() != nil {
+				p += "/32"
+			} else {
+				p += "/128"
+			}
+		}
+		_, n, err := net.ParseCIDR(p)
+		if err != nil {
+			log.Fatalf("Failed to parse trusted proxy %#v, err=%v", p, err)
+		}
+		l.trusted = append(l.trusted, n)
+	}
+
+	return l
+}
+
+func (l *loginLimiter) isTrusted(ip net.IP) bool {
+	for _, n := range l.trusted {
+		if n.Contains(ip) {
+			return true
+		}
+	}
+	return false
+}
+
+// client returns the IP address of the client that sent r. X-Forwarded-For
+// is only considered for requests from trusted proxies, skipping addresses
+// that trusted proxies added themselves.
+func (l *loginLimiter) client(r *http.Request) string {
+	host, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		host = r.RemoteAddr
+	}
+
+	ip := net.ParseIP(host)
+	if ip == nil || !l.isTrusted(ip) {
+		return host
+	}
+
+	var fs []string
+	for _, h := range r.Header["X-Forwarded-For"] {
+		fs = append(fs, strings.Split(h, ",")...)
+	}
+	for i := len(fs) - 1; i >= 0; i-- {
+		f := strings.TrimSpace(fs[i])
+		fip := net.ParseIP(f)
+		if fip == nil {
+			break
+		}
+		host = f
+		if !l.isTrusted(fip) {
+			break
+		}
+	}
+
+	return host
+}
+
+// loginKey identifies the failed logins of client for album a, those of all
+// clients without client.
+func loginKey(client, a string) string {
+	return client + " " + a
+}
+
+// locked returns how long client is still locked out of album a.
+func (l *loginLimiter) locked(client, a string) time.Duration {
+	l.Lock()
+	defer l.Unlock()
+
+	var d time.Duration
+	for _, k := range []string{loginKey(client, a), loginKey("", a)} {
+		if f, ok := l.failed[k]; ok && time.Until(f.lockedUntil) > d {
+			d = time.Until(f.lockedUntil)
+		}
+	}
+	return d
+}
+
+func (l *loginLimiter) fail(client, a string) {
+	now := time.Now()
+	l.Lock()
+	defer l.Unlock()
+
+	l.sweep(now)
+
+	if d, n := l.count(loginKey(client, a), l.attempts, now); d > 0 {
+		log.Printf("Locking out %v from album %#v for %v after %v failed logins.", client, a, d, n)
+	}
+	if d, n := l.count(loginKey("", a), l.albumAttempts, now); d > 0 {
+		log.Printf("Locking out all clients from album %#v for %v after %v failed logins.", a, d, n)
+	}
+}
+
+// count adds a failed login for key k and returns the duration of the
+// lockout once there were at least the given number of attempts, and the
+// number of failed logins. The lock needs to be held.
+func (l *loginLimiter) count(k string, attempts int, now time.Time) (time.Duration, int) {
+	f, ok := l.failed[k]
+	if !ok {
+		f = &failedLogins{}
+		l.failed[k] = f
+	}
+	f.count++
+	f.last = now
+
+	if f.count < attempts {
+		return 0, f.count
+	}
+
+	d := l.lockout
+	for i := attempts; i < f.count && d < maxLockout; i++ {
+		d *= 2
+	}
+	if d > maxLockout {
+		d = maxLockout
+	}
+	f.lockedUntil = now.Add(d)
+	return d, f.count
+}
+
+func (l *loginLimiter) succeed(client, a string) {
+	l.Lock()
+	delete(l.failed, loginKey(client, a))
+	l.Unlock()
+}
+
+// sweep forgets clients without recent failed logins at most once a
+// minute, the lock needs to be held.
+func (l *loginLimiter) sweep(now time.Time) {
+	if now.Sub(l.lastSweep) < time.Minute {
+		return
+	}
+	l.lastSweep = now
+
+	for k, f := range l.failed {
+		if now.Sub(f.last) > failedLoginTTL && now.After(f.lockedUntil) {
+			delete(l.failed, k)
+		}
+	}
+}
+
+func tooManyLogins(w http.ResponseWriter, d time.Duration) {
+	w.Header().Set("Retry-After", strconv.Itoa(int(d.Seconds())+1))
+	http.Error(w, "429 too many failed logins", http.StatusTooManyRequests)
+}
@@ -0,0 +1,228 @@
+package main
+
+import (
+	"bytes"
+	"crypto/subtle"
+	"html/template"
+	"log"
+	"net/http"
+	"net/url"
+	"path"
+	"strings"
+)
+
+var csrfCookieBaseName = "csrf-a2bb9-"
+
+// loginPath and logoutPath are the paths below an album's URL of its login
+// form and of ending its session.
+const (
+	loginPath  = "login"
+	logoutPath = "logout"
+)
+
+var loginPage = template.Must(template.New("loginPage").Parse(loginFormTempl))
+
+type loginDetails struct {
+	Title  string
+	Action string
+	Next   string
+	CSRF   string
+	Failed bool
+}
+
+// loginRedirect returns next if it points into the album and the album's
+// page otherwise, so that the form can't be used to redirect elsewhere.
+func (h *authHandler) loginRedirect(next string) string {
+	if strings.Contains(next, "\\") {
+		return h.urlPath + "/"
+	}
+	if next == h.urlPath || strings.HasPrefix(next, h.urlPath+"/") {
+		return next
+	}
+	return h.urlPath + "/"
+}
+
+func (h *authHandler) csrfCookie(v string, maxAge int) *http.Cookie {
+	return &http.Cookie{
+		Name:     cookieName(csrfCookieBaseName, h.name),
+		Value:    v,
+		Path:     h.urlPath,
+		MaxAge:   maxAge,
+		HttpOnly: true,
+		Secure:   h.secureCookies,
+		SameSite: http.SameSiteStrictMode,
+	}
+}
+
+// redirectToLogin sends visitors to the login form, remembering the
+// requested page. Browsers keep the URL's fragment across the redirect, the
+// form adds it to the page to return to, so PhotoSwipe opens the requested
+// image again.
+func (h *authHandler) redirectToLogin(w http.ResponseWriter, r *http.Request) {
+	next := h.urlPath + r.URL.Path
+	if r.URL.RawQuery != "" {
+		next += "?" + r.URL.RawQuery
+	}
+	u := h.urlPath + "/login?next=" + url.QueryEscape(next)
+	http.Redirect(w, r, u, http.StatusSeeOther)
+}
+
+// login serves the login form and handles its submission.
+func (h *authHandler) login(w http.ResponseWriter, r *http.Request) {
+	switch r.Method {
+	case "GET", "HEAD":
+		next := h.loginRedirect(r.URL.Query().Get("next"))
+		if h.hasSession(r) {
+			http.Redirect(w, r, next, http.StatusSeeOther)
+			return
+		}
+		h.serveLoginForm(w, r, next, false)
+	case "POST":
+		h.submitLogin(w, r)
+	default:
+		w.Header().Set("Allow", "GET, HEAD, POST")
+		http.Error(w, "405 method not allowed", http.StatusMethodNotAllowed)
+	}
+}
+
+func (h *authHandler) submitLogin(w http.ResponseWriter, r *http.Request) {
+	if err := r.ParseForm(); err != nil {
+		http.Error(w, "400 bad request", http.StatusBadRequest)
+		return
+	}
+	next := h.loginRedirect(r.PostForm.Get("next"))
+
+	// the token in the form needs to match the one in the cookie, which
+	// other sites can neither read nor set.
+	c, err := r.Cookie(cookieName(csrfCookieBaseName, h.name))
+	t := r.PostForm.Get("csrf")
+	if err != nil || c.Value == "" || subtle.ConstantTimeCompare([]byte(c.Value), []byte(t)) != 1 {
+		log.Printf("Rejecting login for album %#v with invalid CSRF token.", h.name)
+		http.Error(w, "403 forbidden", http.StatusForbidden)
+		return
+	}
+
+	client := h.limiter.client(r)
+	if d := h.limiter.locked(client, h.realm); d > 0 {
+		tooManyLogins(w, d)
+		return
+	}
+
+	if !checkCredentials(h.creds, r.PostForm.Get("user"), r.PostForm.Get("pass")) {
+		h.limiter.fail(client, h.realm)
+		h.serveLoginForm(w, r, next, true)
+		return
+	}
+	h.limiter.succeed(client, h.realm)
+
+	if !h.startSession(w) {
+		return
+	}
+	http.SetCookie(w, h.csrfCookie("", -1))
+	http.Redirect(w, r, next, http.StatusSeeOther)
+}
+
+func (h *authHandler) serveLoginForm(w http.ResponseWriter, r *http.Request, next string, failed bool) {
+	// keep an existing token, so that forms in other tabs stay valid
+	var t string
+	if c, err := r.Cookie(cookieName(csrfCookieBaseName, h.name)); err == nil && c.Value != "" {
+		t = c.Value
+	} else if t, err = newSessionID(); err != nil {
+		log.Printf("Failed to create CSRF token for album %#v, err=%v", h.name, err)
+		http.Error(w, "500 internal server error", 500)
+		return
+	}
+
+	ld := loginDetails{
+		Title:  h.files.details.Title,
+		Action: h.urlPath + "/" + loginPath,
+		Next:   next,
+		CSRF:   t,
+		Failed: failed,
+	}
+	if ld.Title == "" {
+		ld.Title = path.Base(h.name)
+	}
+
+	var buf bytes.Buffer
+	if err := loginPage.Execute(&buf, ld); err != nil {
+		log.Printf("Failed to render login form for %#v, err=%v", h.name, err)
+		http.Error(w, "500 internal server error", 500)
+		return
+	}
+
+	http.SetCookie(w, h.csrfCookie(t, 0))
+	w.Header().Set("Content-Type", "text/html; charset=utf-8")
+	w.Header().Set("Cache-Control", "no-store")
+	if failed {
+		w.WriteHeader(http.StatusUnauthorized)
+	}
+	w.Write(buf.Bytes())
+}
+
+var (
+	loginFormTempl = `<!doctype html>
+<html>
+    <head>
+        <title>{{.Title}}</title>
+        <meta name="viewport" content="width=device-width, initial-scale=1.0">
+        <link href="https://fonts.googleapis.com/css?family=Raleway:100" rel="stylesheet">
+        <style>
+         body {
+             font-family: Roboto, sans-serif;
+             background-color: #000;
+             color: #fff;
+             margin: 0;
+         }
+         h1 {
+             margin: 0 0 20pt 0;
+             padding: 10pt 10pt 3pt 10pt;
+             text-align: right;
+             font-family: Raleway, sans-serif;
+         }
+         form {
+             display: flex;
+             flex-direction: column;
+             max-width: 300px;
+             margin: 40pt auto;
+             padding: 0 10pt;
+         }
+         input {
+             font-size: 14pt;
+             margin: 0 0 10pt 0;
+             padding: 6pt;
+             border: 1px solid #333;
+             background-color: #111;
+             color: #fff;
+         }
+         input[type=submit] {
+             cursor: pointer;
+         }
+         p.error {
+             color: #f66;
+             margin: 0 0 10pt 0;
+         }
+        </style>
+    </head>
+    <body>
+        <h1>{{.Title}}</h1>
+        <form method="post" action="{{.Action}}" id="login">
+            {{if .Failed}}<p class="error">Wrong user or password.</p>{{end}}
+            <input type="text" name="user" placeholder="User" autocomplete="username" autocapitalize="none" required autofocus>
+            <input type="password" name="pass" placeholder="Password" autocomplete="current-password" required>
+            <input type="hidden" name="csrf" value="{{.CSRF}}">
+            <input type="hidden" name="next" value="{{.Next}}">
+            <input type="submit" value="Log in">
+        </form>
+        <script>
+         document.getElementById('login').addEventListener('submit', function(e) {
+             var next = e.target.elements.next;
+             if (window.location.hash && next.value.indexOf('#') < 0) {
+                 next.value += window.location.hash;
+             }
+         });
+        </script>
+    </body>
+</html>
+`
+)
@@ -1,10 +1,26 @@
 package main
 
+import "os"
+
 func main() {
+	if len(os.Args) > 1 {
+		switch os.Args[1] {
+		case "hash-password":
+			hashPasswordCommand(os.Args[2:])
+			return
+		case "gc":
+			gcCommand(os.Args[2:])
+			return
+		case "share":
+			shareCommand(os.Args[2:])
+			return
+		}
+	}
+
 	conf := mustParseConfig()
 	albums := make(chan []album, 1)
-	w := newWatcher(conf.ReloadDelaySeconds, conf.BilderDir, conf.URLPathPrefix, albums)
-	s := newServer(conf.Addr, conf.BilderDir, conf.AccessLog, albums)
+	w := newWatcher(conf, albums)
+	s := newServer(conf, albums)
 
 	go w.start()
 	s.serve()
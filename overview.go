@@ -0,0 +1,233 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"html/template"
+	"path"
+	"sort"
+	"time"
+)
+
+var overviewPage = template.Must(template.Must(template.New("overview").Parse(overviewTempl)).Parse(albumTilesTempl))
+
+type overviewDetails struct {
+	URLPathPrefix string
+	TileSize      int
+	Albums        []albumTile
+}
+
+// albumTile links to an album on the overview page or the page of its
+// parent album. Locked albums only show their title.
+type albumTile struct {
+	Name      string
+	Title     string
+	Path      string
+	ThumbPath string
+	Count     string
+	Dates     string
+	Locked    bool
+}
+
+// newAlbumTile returns the tile of album a as seen by visitors with access
+// to the albums that use the credentials of album realm, and whether it
+// should be listed. Albums that need other credentials are only listed when
+// listed is explicitly enabled.
+func newAlbumTile(urlPathPrefix string, a album, realm string) (albumTile, bool) {
+	t := albumTile{
+		Name:   a.name,
+		Title:  a.details.Title,
+		Path:   urlPathPrefix + "/b/" + a.name + "/",
+		Locked: a.hasAuth() && a.realm != realm,
+	}
+	if t.Title == "" {
+		t.Title = path.Base(a.name)
+	}
+
+	listed := !t.Locked
+	if a.listed != nil {
+		listed = *a.listed
+	}
+	if t.Locked {
+		return t, listed
+	}
+
+	t.ThumbPath = coverThumb(a.details)
+	t.Dates = dateRange(a.details.Images)
+	switch {
+	case len(a.details.Images) > 0:
+		t.Count = imageCount(len(a.details.Images))
+	case len(a.details.Albums) > 0:
+		t.Count = albumCount(len(a.details.Albums))
+	}
+
+	return t, listed
+}
+
+func newOverview(urlPathPrefix string, tileSize int, as []album) overviewDetails {
+	od := overviewDetails{URLPathPrefix: urlPathPrefix, TileSize: tileSize}
+	for _, a := range as {
+		if parentAlbum(a.name) != "" {
+			continue
+		}
+		if t, listed := newAlbumTile(urlPathPrefix, a, ""); listed {
+			od.Albums = append(od.Albums, t)
+		}
+	}
+
+	sort.Slice(od.Albums, func(i, j int) bool { return od.Albums[i].Name < od.Albums[j].Name })
+	return od
+}
+
+// coverThumb returns the thumb of the album's cover, falling back to the
+// first image in the album's order that has one, or of its first sub-album
+// with a thumb.
+func coverThumb(dd dirDetails) string {
+	if dd.Cover != nil && dd.Cover.ThumbPath != "" {
+		return dd.Cover.ThumbPath
+	}
+	for _, id := range dd.Images {
+		if id.ThumbPath != "" {
+			return id.ThumbPath
+		}
+	}
+	for _, t := range dd.Albums {
+		if t.ThumbPath != "" {
+			return t.ThumbPath
+		}
+	}
+	return ""
+}
+
+func albumCount(n int) string {
+	if n == 1 {
+		return "1 album"
+	}
+	return fmt.Sprintf("%v albums", n)
+}
+
+func imageCount(n int) string {
+	if n == 1 {
+		return "1 image"
+	}
+	return fmt.Sprintf("%v images", n)
+}
+
+func dateRange(ids []*imgDetails) string {
+	var first, last time.Time
+	for _, id := range ids {
+		t := id.taken()
+		if t.IsZero() {
+			continue
+		}
+		if first.IsZero() || t.Before(first) {
+			first = t
+		}
+		if t.After(last) {
+			last = t
+		}
+	}
+
+	const f = "2006-01-02"
+	switch {
+	case first.IsZero():
+		return ""
+	case first.Format(f) == last.Format(f):
+		return first.Format(f)
+	default:
+		return first.Format(f) + " – " + last.Format(f)
+	}
+}
+
+func renderOverview(od overviewDetails) ([]byte, error) {
+	var buf bytes.Buffer
+	if err := overviewPage.Execute(&buf, od); err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
+
+var (
+	overviewTempl = `<!doctype html>
+<html>
+    <head>
+        <title>Albums</title>
+        <meta name="viewport" content="width=device-width, initial-scale=1.0">
+        <link href="https://fonts.googleapis.com/css?family=Raleway:100" rel="stylesheet">
+        <style>
+         body {
+             font-family: Roboto, sans-serif;
+             background-color: #000;
+             color: #fff;
+             margin: 0;
+         }
+         h1 {
+             margin: 0 0 20pt 0;
+             padding: 10pt 10pt 3pt 10pt;
+             text-align: right;
+             font-family: Raleway, sans-serif;
+         }
+{{template "albumTilesStyle" .}}
+        </style>
+    </head>
+    <body>
+        <h1>Albums</h1>
+{{template "albumTiles" .}}
+    </body>
+</html>
+`
+
+	// albumTilesTempl renders the albumTile list of .Albums with tiles of
+	// .TileSize, it's shared by the overview and album pages. Thumbs that
+	// aren't square are cropped to fill their tile.
+	albumTilesTempl = `{{define "albumTilesStyle"}}
+         #albums {
+             display: flex;
+             flex-wrap: wrap;
+             justify-content: center;
+         }
+         #albums figure {
+             margin: 0 0 10pt 0;
+             width: {{.TileSize}}px;
+         }
+         #albums img {
+             object-fit: cover;
+         }
+         #albums a {
+             display: flex;
+             color: #fff;
+             text-decoration: none;
+         }
+         #albums span.placeholder {
+             display: flex;
+             align-items: center;
+             justify-content: center;
+             width: {{.TileSize}}px;
+             height: {{.TileSize}}px;
+             background-color: #111;
+             font-size: 36pt;
+         }
+         #albums figcaption {
+             padding: 4pt 6pt;
+             font-size: 10pt;
+         }
+         #albums figcaption .title {
+             font-weight: bold;
+         }
+         #albums figcaption .details {
+             color: #888;
+         }
+{{end}}{{define "albumTiles"}}
+        <div id="albums">
+{{range .Albums}}
+          <figure{{if .Locked}} class="locked"{{end}}>
+            <a href="{{.Path}}">{{if .ThumbPath}}<img src="{{$.URLPathPrefix}}/{{.ThumbPath}}" width="{{$.TileSize}}" height="{{$.TileSize}}" />{{else if .Locked}}<span class="placeholder">&#x1F512;</span>{{else}}<span class="placeholder"></span>{{end}}</a>
+            <figcaption>
+              <div class="title">{{.Title}}</div>
+              {{if not .Locked}}<div class="details">{{.Count}}{{with .Dates}} · {{.}}{{end}}</div>{{end}}
+            </figcaption>
+          </figure>
+{{end}}
+        </div>
+{{end}}`
+)
@@ -0,0 +1,527 @@
+package main
+
+import (
+	"bytes"
+	"crypto/sha1"
+	"encoding/hex"
+	"encoding/json"
+	"html/template"
+	"log"
+	"net/http"
+	"net/url"
+	"sync"
+	"time"
+)
+
+var dirIndex = template.Must(template.Must(template.New("dirIndex").Parse(dirIndexTempl)).Parse(albumTilesTempl))
+
+func renderPage(dd dirDetails) ([]byte, error) {
+	var buf bytes.Buffer
+	if err := dirIndex.Execute(&buf, dd); err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
+
+// RenditionsJSON returns the renditions of image id for the viewer as JSON,
+// with URLs that are escaped like links so that file names with spaces or
+// commas work.
+func (dd dirDetails) RenditionsJSON(id *imgDetails) (string, error) {
+	type item struct {
+		Src string `json:"src"`
+		W   int    `json:"w"`
+		H   int    `json:"h"`
+	}
+
+	var is []item
+	for _, r := range id.Renditions {
+		u := url.URL{Path: dd.URLPathPrefix + "/" + r.Path}
+		is = append(is, item{Src: u.EscapedPath(), W: r.Width, H: r.Height})
+	}
+	byts, err := json.Marshal(is)
+	return string(byts), err
+}
+
+// cachedPage renders a page on first request and serves it from memory
+// afterwards.
+type cachedPage struct {
+	name    string
+	render  func() ([]byte, error)
+	modTime time.Time
+
+	once sync.Once
+	page []byte
+	etag string
+	err  error
+}
+
+func newCachedPage(name string, render func() ([]byte, error)) *cachedPage {
+	return &cachedPage{name: name, render: render, modTime: time.Now()}
+}
+
+func (cp *cachedPage) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	cp.once.Do(func() {
+		cp.page, cp.err = cp.render()
+		if cp.err != nil {
+			log.Printf("Failed to render page for %#v, err=%v", cp.name, cp.err)
+			return
+		}
+		sum := sha1.Sum(cp.page)
+		cp.etag = `"` + hex.EncodeToString(sum[:]) + `"`
+	})
+
+	if cp.err != nil {
+		http.Error(w, "500 internal server error", 500)
+		return
+	}
+
+	w.Header().Set("Content-Type", "text/html; charset=utf-8")
+	w.Header().Set("Cache-Control", "no-cache")
+	w.Header().Set("ETag", cp.etag)
+	http.ServeContent(w, r, "index.html", cp.modTime, bytes.NewReader(cp.page))
+}
+
+var (
+	dirIndexTempl = `<!doctype html>
+<html>
+    <head>
+        <title>{{.Title}}</title>
+        <meta name="viewport" content="width=device-width, initial-scale=1.0">
+        <meta property="og:type" content="website">
+        <meta property="og:title" content="{{.Title}}">
+        {{with .Cover}}{{if .CoverPath}}<meta property="og:image" content="{{$.PublicURL}}{{$.URLPathPrefix}}/{{.CoverPath}}">{{end}}{{end}}
+        <link href="https://fonts.googleapis.com/css?family=Raleway:100" rel="stylesheet">
+        <link rel="stylesheet" href="{{.URLPathPrefix}}/a/photoswipe.css">
+        <link rel="stylesheet" href="{{.URLPathPrefix}}/a/default-skin.css">
+        <script src="{{.URLPathPrefix}}/a/photoswipe.min.js"></script>
+        <script src="{{.URLPathPrefix}}/a/photoswipe-ui-default.min.js"></script>
+        <style>
+         body {
+             font-family: Roboto, sans-serif;
+             background-color: #000;
+             margin: 0;
+         }
+         h1 {
+             color: #fff;
+             margin: 0 0 20pt 0;
+             padding: 10pt 10pt 3pt 10pt;
+             text-align: right;
+             font-family: Raleway, sans-serif;
+         }
+         h1 a {
+             color: #888;
+             text-decoration: none;
+         }
+{{template "albumTilesStyle" .}}
+         #gallery-overview figure {
+             margin: 0px;
+{{if eq .Thumbs.Aspect "square"}}
+             max-width: {{.Thumbs.Size}}px;
+{{end}}
+         }
+         #gallery-overview figure a {
+             display: flex;
+         }
+         #gallery-overview img.placeholder {
+             object-fit: none;
+             background-color: #111;
+         }
+         #gallery-overview span.placeholder {
+             width: {{.Thumbs.Size}}px;
+             height: {{.Thumbs.Size}}px;
+             background-color: #111;
+         }
+         #gallery-overview figure a.video {
+             position: relative;
+         }
+         #gallery-overview figure a.video::after {
+             content: "\25B6";
+             position: absolute;
+             right: 8px;
+             bottom: 4px;
+             color: #fff;
+             font-size: 18pt;
+             text-shadow: 0 0 4px #000;
+         }
+         .pswp__video {
+             display: flex;
+             align-items: center;
+             justify-content: center;
+             width: 100%;
+             height: 100%;
+         }
+         .pswp__video video {
+             max-width: 100%;
+             max-height: 100%;
+         }
+         #gallery-overview figcaption {
+             font-size: 9pt;
+             font-weight: bold;
+             text-align: center;
+             display: none;
+         }
+         #gallery-overview dl.exif {
+             display: none;
+         }
+         .pswp__button--exif {
+             background: none !important;
+             color: #fff;
+             font: bold 18px serif;
+         }
+         .pswp__exif {
+             display: none;
+             position: absolute;
+             top: 44px;
+             right: 0;
+             padding: 10px 15px;
+             background-color: rgba(0, 0, 0, 0.5);
+             color: #ccc;
+             font-size: 10pt;
+         }
+         .pswp__exif--visible {
+             display: block;
+         }
+         .pswp__exif dt {
+             float: left;
+             clear: left;
+             width: 90px;
+             color: #888;
+         }
+         .pswp__exif dd {
+             margin-left: 90px;
+         }
+         #gallery-overview {
+             display: flex;
+             flex-wrap: wrap;
+             justify-content: center;
+         }
+        </style>
+    </head>
+    <body>
+        <h1>{{range .Breadcrumbs}}<a href="{{.Path}}">{{.Title}}</a> / {{end}}{{.Title}}</h1>
+{{if .Albums}}{{template "albumTiles" .}}{{end}}
+        <div class="pswp" tabindex="-1" role="dialog" aria-hidden="true">
+            <div class="pswp__bg"></div>
+            <div class="pswp__scroll-wrap">
+                <div class="pswp__container">
+                    <div class="pswp__item"></div>
+                    <div class="pswp__item"></div>
+                    <div class="pswp__item"></div>
+                </div>
+                <div class="pswp__ui pswp__ui--hidden">
+                    <div class="pswp__top-bar">
+                        <div class="pswp__counter"></div>
+                        <button class="pswp__button pswp__button--close" title="Close (Esc)"></button>
+                        <button class="pswp__button pswp__button--share" title="Share"></button>
+                        <button class="pswp__button pswp__button--fs" title="Toggle fullscreen"></button>
+                        <button class="pswp__button pswp__button--zoom" title="Zoom in/out"></button>
+{{if .ShowExif}}
+                        <button class="pswp__button pswp__button--exif" title="Show camera settings">i</button>
+{{end}}
+                        <div class="pswp__preloader">
+                            <div class="pswp__preloader__icn">
+                                <div class="pswp__preloader__cut">
+                                    <div class="pswp__preloader__donut"></div>
+                                </div>
+                            </div>
+                        </div>
+                    </div>
+                    <div class="pswp__share-modal pswp__share-modal--hidden pswp__single-tap">
+                        <div class="pswp__share-tooltip"></div>
+                    </div>
+                    <button class="pswp__button pswp__button--arrow--left" title="Previous (arrow left)">
+                    </button>
+                    <button class="pswp__button pswp__button--arrow--right" title="Next (arrow right)">
+                    </button>
+                    <div class="pswp__caption">
+                        <div class="pswp__caption__center"></div>
+                    </div>
+{{if .ShowExif}}
+                    <div class="pswp__exif"></div>
+{{end}}
+                </div>
+            </div>
+        </div>
+        <div id="gallery-overview" class="gallery-overview">
+{{range .Images}}
+          <figure>
+            <a href="{{$.URLPathPrefix}}/{{.Path}}" data-size="{{.Width}}x{{.Height}}" data-type="{{.Type}}"{{with .PosterPath}} data-poster="{{$.URLPathPrefix}}/{{.}}"{{end}}{{if .Renditions}} data-renditions="{{$.RenditionsJSON .}}"{{end}} class="{{.Type}}">{{if .ThumbPath}}<img src="{{$.URLPathPrefix}}/{{.ThumbPath}}"{{with .Thumb2xPath}} srcset="{{$.URLPathPrefix}}/{{.}} 2x"{{end}} width="{{.ThumbWidth}}" height="{{.ThumbHeight}}" />{{else if eq .Type "video"}}<span class="placeholder"></span>{{else}}<img class="placeholder" src="{{$.URLPathPrefix}}/a/preloader.gif" width="{{.ThumbWidth}}" height="{{.ThumbHeight}}" />{{end}}</a>
+            <figcaption>{{.Caption}}&nbsp;</figcaption>
+{{if $.ShowExif}}{{with .Exif}}{{if not .Empty}}
+            <dl class="exif">
+              {{with .Camera}}<dt>Camera</dt><dd>{{.}}</dd>{{end}}
+              {{with .Lens}}<dt>Lens</dt><dd>{{.}}</dd>{{end}}
+              {{with .Focal}}<dt>Focal length</dt><dd>{{.}}</dd>{{end}}
+              {{with .Aperture}}<dt>Aperture</dt><dd>{{.}}</dd>{{end}}
+              {{with .Shutter}}<dt>Shutter</dt><dd>{{.}}</dd>{{end}}
+              {{with .ISO}}<dt>ISO</dt><dd>{{.}}</dd>{{end}}
+              {{if not .Taken.IsZero}}<dt>Taken</dt><dd>{{.Taken.Format "2006-01-02 15:04"}}</dd>{{end}}
+            </dl>
+{{end}}{{end}}{{end}}
+          </figure>
+{{end}}
+        </div>
+        <script>
+         var videoHTML = function(src, poster) {
+             var video = document.createElement('video');
+             video.setAttribute('controls', '');
+             video.setAttribute('preload', 'metadata');
+             video.setAttribute('src', src);
+             if(poster) {
+                 video.setAttribute('poster', poster);
+             }
+             var wrap = document.createElement('div');
+             wrap.className = 'pswp__video';
+             wrap.appendChild(video);
+             return wrap.outerHTML;
+         };
+
+         // renditions are listed as JSON of {src, w, h}, smallest first
+         var parseRenditions = function(attr) {
+             if(!attr) {
+                 return [];
+             }
+             try {
+                 return JSON.parse(attr);
+             } catch(e) {
+                 return [];
+             }
+         };
+
+         // displayRendition returns the smallest rendition that fills the
+         // viewport at its pixel density, or the original.
+         var displayRendition = function(item, viewportSize) {
+             var o = item.original,
+                 dpr = window.devicePixelRatio || 1,
+                 scale = Math.min(1, viewportSize.x * dpr / o.w, viewportSize.y * dpr / o.h),
+                 needed = o.w * scale;
+             for(var i = 0; i < item.renditions.length; i++) {
+                 if(item.renditions[i].w >= needed) {
+                     return item.renditions[i];
+                 }
+             }
+             return o;
+         };
+
+         var parseThumbnailElements = function(el) {
+             var thumbElements = el.childNodes,
+                 numNodes = thumbElements.length,
+                 items = [],
+                 figureEl,
+                 linkEl,
+                 size,
+                 item;
+             for(var i = 0; i < numNodes; i++) {
+                 figureEl = thumbElements[i];
+                 if(figureEl.nodeType !== 1) {
+                     continue;
+                 }
+                 linkEl = figureEl.children[0];
+                 size = linkEl.getAttribute('data-size').split('x');
+                 if(linkEl.getAttribute('data-type') === 'video') {
+                     item = {html: videoHTML(linkEl.getAttribute('href'), linkEl.getAttribute('data-poster'))};
+                 } else {
+                     item = {
+                         src: linkEl.getAttribute('href'),
+                         w: parseInt(size[0], 10),
+                         h: parseInt(size[1], 10)
+                     };
+                     item.original = {src: item.src, w: item.w, h: item.h};
+                     item.renditions = parseRenditions(linkEl.getAttribute('data-renditions'));
+                 }
+                 if(figureEl.children.length > 1) {
+                     item.title = figureEl.children[1].innerHTML;
+                 }
+                 if(figureEl.children.length > 2) {
+                     item.exif = figureEl.children[2].innerHTML;
+                 }
+                 if(linkEl.children.length > 0) {
+                     item.msrc = linkEl.children[0].getAttribute('src');
+                 }
+                 item.el = figureEl;
+                 items.push(item);
+             }
+             return items;
+         };
+
+         // find nearest parent element
+         var closest = function closest(el, fn) {
+             return el && ( fn(el) ? el : closest(el.parentNode, fn) );
+         };
+
+         // triggers when user clicks on thumbnail
+         var onThumbnailsClick = function(e) {
+             e = e || window.event;
+             e.preventDefault ? e.preventDefault() : e.returnValue = false;
+             var eTarget = e.target || e.srcElement;
+             // find root element of slide
+             var clickedListItem = closest(eTarget, function(el) {
+                 return (el.tagName && el.tagName.toUpperCase() === 'FIGURE');
+             });
+             if(!clickedListItem) {
+                 return;
+             }
+
+             // find index of clicked item by looping through all child nodes
+             // alternatively, you may define index via data- attribute
+             var clickedGallery = clickedListItem.parentNode,
+                 childNodes = clickedListItem.parentNode.childNodes,
+                 numChildNodes = childNodes.length,
+                 nodeIndex = 0,
+                 index;
+             for (var i = 0; i < numChildNodes; i++) {
+                 if(childNodes[i].nodeType !== 1) {
+                     continue;
+                 }
+                 if(childNodes[i] === clickedListItem) {
+                     index = nodeIndex;
+                     break;
+                 }
+                 nodeIndex++;
+             }
+
+             if(index >= 0) {
+                 openPhotoSwipe( index, clickedGallery );
+             }
+             console.log("couldn't find a valid index, not opening");
+             return false;
+         };
+
+         // parse picture index and gallery index from URL (#&pid=1&gid=2)
+         var photoswipeParseHash = function() {
+             var hash = window.location.hash.substring(1),
+                 params = {};
+
+             if(hash.length < 5) {
+                 return params;
+             }
+
+             var vars = hash.split('&');
+             for (var i = 0; i < vars.length; i++) {
+                 if(!vars[i]) {
+                     continue;
+                 }
+                 var pair = vars[i].split('=');
+                 if(pair.length < 2) {
+                     continue;
+                 }
+                 params[pair[0]] = pair[1];
+             }
+
+             if(params.gid) {
+                 params.gid = parseInt(params.gid, 10);
+             }
+
+             return params;
+         };
+
+         var openPhotoSwipe = function(index, galleryElement, disableAnimation, fromURL) {
+             var pswpElement = document.querySelectorAll('.pswp')[0],
+                 gallery,
+                 options,
+                 items;
+             items = parseThumbnailElements(galleryElement);
+             options = {
+                 galleryUID: galleryElement.getAttribute('data-pswp-uid'),
+                 getImageURLForShare: function() {
+                     var item = gallery.currItem;
+                     return item.original ? item.original.src : (item.src || '');
+                 },
+                 shareButtons: [
+                     {id:'download', label:'Download image', url:'{{"{{"}}raw_image_url{{"}}"}}', download:true}
+                 ],
+                 showHideOpacity: false,
+                 showAnimationDuration: 0,
+                 hideAnimationDuration: 0
+             };
+
+             if(fromURL) {
+                 if(options.galleryPIDs) {
+                     for(var j = 0; j < items.length; j++) {
+                         if(items[j].pid == index) {
+                             options.index = j;
+                             break;
+                         }
+                     }
+                 } else {
+                     options.index = parseInt(index, 10) - 1;
+                 }
+             } else {
+                 options.index = parseInt(index, 10);
+             }
+
+             // exit if index not found
+             if( isNaN(options.index) ) {
+                 console.log("couldn't find index in open")
+                 return;
+             }
+
+             if(disableAnimation) {
+                 options.showAnimationDuration = 0;
+             }
+
+             gallery = new PhotoSwipe( pswpElement, PhotoSwipeUI_Default, items, options);
+
+             // load the rendition that fits the viewport rather than the
+             // original, and switch when the viewport grows.
+             var viewportSize;
+             gallery.listen('beforeResize', function() {
+                 if(viewportSize && (gallery.viewportSize.x > viewportSize.x || gallery.viewportSize.y > viewportSize.y)) {
+                     gallery.invalidateCurrItems();
+                 }
+                 viewportSize = {x: gallery.viewportSize.x, y: gallery.viewportSize.y};
+             });
+             gallery.listen('gettingData', function(index, item) {
+                 if(!item.original) {
+                     return;
+                 }
+                 var r = displayRendition(item, gallery.viewportSize);
+                 if(item.src !== r.src) {
+                     item.src = r.src;
+                     item.w = r.w;
+                     item.h = r.h;
+                 }
+             });
+             gallery.init();
+             gallery.listen('beforeChange', function() {
+                 var videos = pswpElement.querySelectorAll('.pswp__video video');
+                 for(var i = 0; i < videos.length; i++) {
+                     videos[i].pause();
+                 }
+             });
+             gallery.listen('close', function() {
+                 var videos = pswpElement.querySelectorAll('.pswp__video video');
+                 for(var i = 0; i < videos.length; i++) {
+                     videos[i].pause();
+                 }
+             });
+{{if .ShowExif}}
+             var exifEl = pswpElement.querySelector('.pswp__exif');
+             var showExif = function() {
+                 exifEl.innerHTML = gallery.currItem.exif || 'No camera settings available.';
+             };
+             pswpElement.querySelector('.pswp__button--exif').onclick = function(e) {
+                 e.preventDefault();
+                 exifEl.classList.toggle('pswp__exif--visible');
+                 showExif();
+             };
+             gallery.listen('afterChange', showExif);
+             gallery.listen('close', function() {
+                 exifEl.classList.remove('pswp__exif--visible');
+             });
+{{end}}
+         };
+
+         var initPhotoSwipeFromDOM = function(gallerySelector) {
+             var galleryElements = document.querySelectorAll( gallerySelector );
+             for(var i = 0, l = galleryElements.length; i < l; i++) {
+                 galleryElements[i].setAttribute('data-pswp-uid', i+1);
+                 galleryElements[i].onclick = onThumbnailsClick;
+             }
+         };
+         initPhotoSwipeFromDOM('.gallery-overview');
+        </script>
+    </body>
+</html>
+`
+)
@@ -0,0 +1,170 @@
+package main
+
+import (
+	"bufio"
+	"crypto/rand"
+	"crypto/subtle"
+	"encoding/base64"
+	"flag"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"strings"
+
+	"golang.org/x/crypto/argon2"
+	"golang.org/x/crypto/bcrypt"
+	"golang.org/x/term"
+)
+
+// parameters for new argon2id hashes, as recommended by RFC 9106.
+const (
+	argon2Time    = 1
+	argon2Memory  = 64 * 1024
+	argon2Threads = 4
+	argon2KeyLen  = 32
+	argon2SaltLen = 16
+)
+
+// dummyHash is checked against for unknown users, so that they take about
+// as long to reject as known users with a wrong password.
+const dummyHash = "$2a$10$LcEpdA6MQj741eHEW1L1K.shkRQPHisw/Aw3ciuZworKg5lH2mfw."
+
+func isBcryptHash(p string) bool {
+	return strings.HasPrefix(p, "$2a$") || strings.HasPrefix(p, "$2b$") || strings.HasPrefix(p, "$2y$")
+}
+
+func isArgon2Hash(p string) bool {
+	return strings.HasPrefix(p, "$argon2id$")
+}
+
+func isPasswordHash(p string) bool {
+	return isBcryptHash(p) || isArgon2Hash(p)
+}
+
+// checkPassword reports whether pass matches the configured password cp,
+// which is either a bcrypt or argon2id hash or plaintext.
+func checkPassword(cp, pass string) bool {
+	switch {
+	case isBcryptHash(cp):
+		return bcrypt.CompareHashAndPassword([]byte(cp), []byte(pass)) == nil
+	case isArgon2Hash(cp):
+		return checkArgon2(cp, pass)
+	default:
+		return subtle.ConstantTimeCompare([]byte(cp), []byte(pass)) == 1
+	}
+}
+
+// checkCredentials reports whether user and pass match any of the given
+// credentials, which map user names to configured passwords.
+func checkCredentials(creds map[string]string, user, pass string) bool {
+	var cp string
+	found := false
+	for u, p := range creds {
+		if subtle.ConstantTimeCompare([]byte(u), []byte(user)) == 1 {
+			cp, found = p, true
+		}
+	}
+
+	if !found {
+		checkPassword(dummyHash, pass)
+		return false
+	}
+
+	return checkPassword(cp, pass)
+}
+
+// checkArgon2 verifies pass against an argon2id hash in the PHC string
+// format, e.g. $argon2id$v=19$m=65536,t=1,p=4$<salt>$<key>
+func checkArgon2(h, pass string) bool {
+	ps := strings.Split(h, "$")
+	if len(ps) != 6 {
+		return false
+	}
+
+	var v int
+	if _, err := fmt.Sscanf(ps[2], "v=%d", &v); err != nil || v != argon2.Version {
+		return false
+	}
+
+	var m, t uint32
+	var p uint8
+	if _, err := fmt.Sscanf(ps[3], "m=%d,t=%d,p=%d", &m, &t, &p); err != nil || t == 0 || p == 0 {
+		return false
+	}
+
+	salt, err := base64.RawStdEncoding.DecodeString(ps[4])
+	if err != nil {
+		return false
+	}
+
+	key, err := base64.RawStdEncoding.DecodeString(ps[5])
+	if err != nil || len(key) == 0 {
+		return false
+	}
+
+	k := argon2.IDKey([]byte(pass), salt, t, m, p, uint32(len(key)))
+	return subtle.ConstantTimeCompare(k, key) == 1
+}
+
+func hashPassword(alg, pass string) (string, error) {
+	switch alg {
+	case "bcrypt":
+		h, err := bcrypt.GenerateFromPassword([]byte(pass), bcrypt.DefaultCost)
+		return string(h), err
+	case "argon2id":
+		salt := make([]byte, argon2SaltLen)
+		if _, err := rand.Read(salt); err != nil {
+			return "", err
+		}
+		k := argon2.IDKey([]byte(pass), salt, argon2Time, argon2Memory, argon2Threads, argon2KeyLen)
+		return fmt.Sprintf(
+			"$argon2id$v=%d$m=%d,t=%d,p=%d$%s$%s",
+			argon2.Version, argon2Memory, argon2Time, argon2Threads,
+			base64.RawStdEncoding.EncodeToString(salt),
+			base64.RawStdEncoding.EncodeToString(k),
+		), nil
+	default:
+		return "", fmt.Errorf("unsupported algorithm %#v", alg)
+	}
+}
+
+// readPassword reads a password from stdin, without echoing it if stdin is
+// a terminal.
+func readPassword() (string, error) {
+	fd := int(os.Stdin.Fd())
+	if term.IsTerminal(fd) {
+		fmt.Fprint(os.Stderr, "Password: ")
+		byts, err := term.ReadPassword(fd)
+		fmt.Fprintln(os.Stderr)
+		return string(byts), err
+	}
+
+	l, err := bufio.NewReader(os.Stdin).ReadString('\n')
+	if err != nil && err != io.EOF {
+		return "", err
+	}
+	return strings.TrimRight(l, "\r\n"), nil
+}
+
+// hashPasswordCommand implements `bilder hash-password` which prints the
+// hash of a password read from stdin for use in bilder.json.
+func hashPasswordCommand(args []string) {
+	fs := flag.NewFlagSet("hash-password", flag.ExitOnError)
+	alg := fs.String("algorithm", "bcrypt", "Hash algorithm, bcrypt or argon2id.")
+	fs.Parse(args)
+
+	pass, err := readPassword()
+	if err != nil {
+		log.Fatalf("Failed to read password, err=%v", err)
+	}
+	if pass == "" {
+		log.Fatalf("Password must not be empty.")
+	}
+
+	h, err := hashPassword(*alg, pass)
+	if err != nil {
+		log.Fatalf("Failed to hash password, err=%v", err)
+	}
+	fmt.Println(h)
+}
@@ -0,0 +1,80 @@
+package main
+
+import (
+	"encoding/base64"
+	"strings"
+	"testing"
+
+	"golang.org/x/crypto/argon2"
+)
+
+func TestCheckCredentials(t *testing.T) {
+	bh, err := hashPassword("bcrypt", "secret")
+	if err != nil {
+		t.Fatal(err)
+	}
+	ah, err := hashPassword("argon2id", "secret")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	creds := map[string]string{"bea": bh, "ari": ah, "pia": "plain"}
+	for _, tt := range []struct {
+		user, pass string
+		expected   bool
+	}{
+		{"bea", "secret", true},
+		{"bea", "wrong", false},
+		{"bea", "", false},
+		{"ari", "secret", true},
+		{"ari", "wrong", false},
+		{"pia", "plain", true},
+		{"pia", "plai", false},
+		{"pia", "plainer", false},
+		{"unknown", "secret", false},
+		{"", "", false},
+	} {
+		if actual := checkCredentials(creds, tt.user, tt.pass); actual != tt.expected {
+			t.Errorf("checkCredentials for %#v with %#v: expected %v, got %v", tt.user, tt.pass, tt.expected, actual)
+		}
+	}
+}
+
+func TestHashPasswordUnsupportedAlgorithm(t *testing.T) {
+	if _, err := hashPassword("md5", "secret"); err == nil {
+		t.Errorf("Expected error for unsupported algorithm")
+	}
+}
+
+func TestCheckArgon2(t *testing.T) {
+	salt := base64.RawStdEncoding.EncodeToString([]byte("saltsaltsaltsalt"))
+	key := base64.RawStdEncoding.EncodeToString(argon2.IDKey([]byte("secret"), []byte("saltsaltsaltsalt"), 1, 1024, 1, 16))
+	phc := func(v, params, salt, key string) string {
+		return strings.Join([]string{"", "argon2id", v, params, salt, key}, "$")
+	}
+
+	for _, tt := range []struct {
+		name     string
+		hash     string
+		pass     string
+		expected bool
+	}{
+		{"valid", phc("v=19", "m=1024,t=1,p=1", salt, key), "secret", true},
+		{"wrong password", phc("v=19", "m=1024,t=1,p=1", salt, key), "Secret", false},
+		{"other parameters", phc("v=19", "m=1024,t=2,p=1", salt, key), "secret", false},
+		{"too few fields", strings.TrimSuffix(phc("v=19", "m=1024,t=1,p=1", salt, ""), "$"), "secret", false},
+		{"too many fields", phc("v=19", "m=1024,t=1,p=1", salt, key) + "$", "secret", false},
+		{"missing version", phc("v=", "m=1024,t=1,p=1", salt, key), "secret", false},
+		{"other version", phc("v=16", "m=1024,t=1,p=1", salt, key), "secret", false},
+		{"zero time", phc("v=19", "m=1024,t=0,p=1", salt, key), "secret", false},
+		{"zero threads", phc("v=19", "m=1024,t=1,p=0", salt, key), "secret", false},
+		{"malformed parameters", phc("v=19", "m=1024;t=1;p=1", salt, key), "secret", false},
+		{"bad salt", phc("v=19", "m=1024,t=1,p=1", "c2Fsd!!!", key), "secret", false},
+		{"bad key", phc("v=19", "m=1024,t=1,p=1", salt, "a2V5!!!"), "secret", false},
+		{"empty key", phc("v=19", "m=1024,t=1,p=1", salt, ""), "secret", false},
+	} {
+		if actual := checkPassword(tt.hash, tt.pass); actual != tt.expected {
+			t.Errorf("%v: expected %v, got %v", tt.name, tt.expected, actual)
+		}
+	}
+}
@@ -0,0 +1,433 @@
+package main
+
+import (
+	"bufio"
+	"errors"
+	"image"
+	"image/color"
+	"io"
+	"math"
+)
+
+// Go's image/jpeg decodes progressive JPEG images but only encodes baseline
+// ones, encodeProgressive writes progressive images for thumbs. Browsers
+// show them at a low resolution while they're loading. The image is
+// written with the quantization and Huffman tables of the JPEG spec, in scans of the DC coefficients, the first luminance
+// AC coefficients, the chrominance AC coefficients and the remaining
+// luminance AC coefficients.
+
+// zigzag maps the zig-zag order of a block's coefficients to their natural
+// order.
+var zigzag = [64]int{
+	0, 1, 8, 16, 9, 2, 3, 10,
+	17, 24, 32, 25, 18, 11, 4, 5,
+	12, 19, 26, 33, 40, 48, 41, 34,
+	27, 20, 13, 6, 7, 14, 21, 28,
+	35, 42, 49, 56, 57, 50, 43, 36,
+	29, 22, 15, 23, 30, 37, 44, 51,
+	58, 59, 52, 45, 38, 31, 39, 46,
+	53, 60, 61, 54, 47, 55, 62, 63,
+}
+
+// unscaledQuant are the quantization tables of section K.1 of the spec in
+// zig-zag order, they're scaled by the quality like Go's encoder does.
+var unscaledQuant = [2][64]byte{
+	// luminance
+	{
+		16, 11, 12, 14, 12, 10, 16, 14,
+		13, 14, 18, 17, 16, 19, 24, 40,
+		26, 24, 22, 22, 24, 49, 35, 37,
+		29, 40, 58, 51, 61, 60, 57, 51,
+		56, 55, 64, 72, 92, 78, 64, 68,
+		87, 69, 55, 56, 80, 109, 81, 87,
+		95, 98, 103, 104, 103, 62, 77, 113,
+		121, 112, 100, 120, 92, 101, 103, 99,
+	},
+	// chrominance
+	{
+		17, 18, 18, 24, 21, 24, 47, 26,
+		26, 47, 99, 66, 56, 66, 99, 99,
+		99, 99, 99, 99, 99, 99, 99, 99,
+		99, 99, 99, 99, 99, 99, 99, 99,
+		99, 99, 99, 99, 99, 99, 99, 99,
+		99, 99, 99, 99, 99, 99, 99, 99,
+		99, 99, 99, 99, 99, 99, 99, 99,
+		99, 99, 99, 99, 99, 99, 99, 99,
+	},
+}
+
+type huffmanSpec struct {
+	count [16]byte // number of codes of length i+1
+	value []byte
+}
+
+// huffmanSpecs are the Huffman tables of section K.3 of the spec. The AC
+// tables don't have codes for runs of end of blocks, so every block of a
+// scan ends with its own end of block.
+var huffmanSpecs = [4]huffmanSpec{
+	// luminance DC
+	{
+		[16]byte{0, 1, 5, 1, 1, 1, 1, 1, 1, 0, 0, 0, 0, 0, 0, 0},
+		[]byte{0, 1, 2, 3, 4, 5, 6, 7, 8, 9, 10, 11},
+	},
+	// luminance AC
+	{
+		[16]byte{0, 2, 1, 3, 3, 2, 4, 3, 5, 5, 4, 4, 0, 0, 1, 125},
+		[]byte{
+			0x01, 0x02, 0x03, 0x00, 0x04, 0x11, 0x05, 0x12,
+			0x21, 0x31, 0x41, 0x06, 0x13, 0x51, 0x61, 0x07,
+			0x22, 0x71, 0x14, 0x32, 0x81, 0x91, 0xa1, 0x08,
+			0x23, 0x42, 0xb1, 0xc1, 0x15, 0x52, 0xd1, 0xf0,
+			0x24, 0x33, 0x62, 0x72, 0x82, 0x09, 0x0a, 0x16,
+			0x17, 0x18, 0x19, 0x1a, 0x25, 0x26, 0x27, 0x28,
+			0x29, 0x2a, 0x34, 0x35, 0x36, 0x37, 0x38, 0x39,
+			0x3a, 0x43, 0x44, 0x45, 0x46, 0x47, 0x48, 0x49,
+			0x4a, 0x53, 0x54, 0x55, 0x56, 0x57, 0x58, 0x59,
+			0x5a, 0x63, 0x64, 0x65, 0x66, 0x67, 0x68, 0x69,
+			0x6a, 0x73, 0x74, 0x75, 0x76, 0x77, 0x78, 0x79,
+			0x7a, 0x83, 0x84, 0x85, 0x86, 0x87, 0x88, 0x89,
+			0x8a, 0x92, 0x93, 0x94, 0x95, 0x96, 0x97, 0x98,
+			0x99, 0x9a, 0xa2, 0xa3, 0xa4, 0xa5, 0xa6, 0xa7,
+			0xa8, 0xa9, 0xaa, 0xb2, 0xb3, 0xb4, 0xb5, 0xb6,
+			0xb7, 0xb8, 0xb9, 0xba, 0xc2, 0xc3, 0xc4, 0xc5,
+			0xc6, 0xc7, 0xc8, 0xc9, 0xca, 0xd2, 0xd3, 0xd4,
+			0xd5, 0xd6, 0xd7, 0xd8, 0xd9, 0xda, 0xe1, 0xe2,
+			0xe3, 0xe4, 0xe5, 0xe6, 0xe7, 0xe8, 0xe9, 0xea,
+			0xf1, 0xf2, 0xf3, 0xf4, 0xf5, 0xf6, 0xf7, 0xf8,
+			0xf9, 0xfa,
+		},
+	},
+	// chrominance DC
+	{
+		[16]byte{0, 3, 1, 1, 1, 1, 1, 1, 1, 1, 1, 0, 0, 0, 0, 0},
+		[]byte{0, 1, 2, 3, 4, 5, 6, 7, 8, 9, 10, 11},
+	},
+	// chrominance AC
+	{
+		[16]byte{0, 2, 1, 2, 4, 4, 3, 4, 7, 5, 4, 4, 0, 1, 2, 119},
+		[]byte{
+			0x00, 0x01, 0x02, 0x03, 0x11, 0x04, 0x05, 0x21,
+			0x31, 0x06, 0x12, 0x41, 0x51, 0x07, 0x61, 0x71,
+			0x13, 0x22, 0x32, 0x81, 0x08, 0x14, 0x42, 0x91,
+			0xa1, 0xb1, 0xc1, 0x09, 0x23, 0x33, 0x52, 0xf0,
+			0x15, 0x62, 0x72, 0xd1, 0x0a, 0x16, 0x24, 0x34,
+			0xe1, 0x25, 0xf1, 0x17, 0x18, 0x19, 0x1a, 0x26,
+			0x27, 0x28, 0x29, 0x2a, 0x35, 0x36, 0x37, 0x38,
+			0x39, 0x3a, 0x43, 0x44, 0x45, 0x46, 0x47, 0x48,
+			0x49, 0x4a, 0x53, 0x54, 0x55, 0x56, 0x57, 0x58,
+			0x59, 0x5a, 0x63, 0x64, 0x65, 0x66, 0x67, 0x68,
+			0x69, 0x6a, 0x73, 0x74, 0x75, 0x76, 0x77, 0x78,
+			0x79, 0x7a, 0x82, 0x83, 0x84, 0x85, 0x86, 0x87,
+			0x88, 0x89, 0x8a, 0x92, 0x93, 0x94, 0x95, 0x96,
+			0x97, 0x98, 0x99, 0x9a, 0xa2, 0xa3, 0xa4, 0xa5,
+			0xa6, 0xa7, 0xa8, 0xa9, 0xaa, 0xb2, 0xb3, 0xb4,
+			0xb5, 0xb6, 0xb7, 0xb8, 0xb9, 0xba, 0xc2, 0xc3,
+			0xc4, 0xc5, 0xc6, 0xc7, 0xc8, 0xc9, 0xca, 0xd2,
+			0xd3, 0xd4, 0xd5, 0xd6, 0xd7, 0xd8, 0xd9, 0xda,
+			0xe2, 0xe3, 0xe4, 0xe5, 0xe6, 0xe7, 0xe8, 0xe9,
+			0xea, 0xf2, 0xf3, 0xf4, 0xf5, 0xf6, 0xf7, 0xf8,
+			0xf9, 0xfa,
+		},
+	},
+}
+
+// huffmanCode is the code of length bits of a value in a Huffman table.
+type huffmanCode struct {
+	code   uint32
+	length uint
+}
+
+func huffmanCodes(s huffmanSpec) [256]huffmanCode {
+	var hc [256]huffmanCode
+	code, k := uint32(0), 0
+	for i, n := range s.count {
+		for j := byte(0); j < n; j++ {
+			hc[s.value[k]] = huffmanCode{code: code, length: uint(i + 1)}
+			code++
+			k++
+		}
+		code <<= 1
+	}
+	return hc
+}
+
+// dctCos holds the factors of the one-dimensional DCT, including the
+// normalization.
+var dctCos = func() (c [8][8]float64) {
+	for x := 0; x < 8; x++ {
+		for u := 0; u < 8; u++ {
+			c[x][u] = math.Cos(float64(2*x+1)*float64(u)*math.Pi/16) / 2
+			if u == 0 {
+				c[x][u] /= math.Sqrt2
+			}
+		}
+	}
+	return
+}()
+
+// fdct returns the quantized DCT coefficients of block b in zig-zag order.
+func fdct(b *[64]float64, q *[64]int) (zz [64]int) {
+	var rows [64]float64
+	for y := 0; y < 8; y++ {
+		for u := 0; u < 8; u++ {
+			var s float64
+			for x := 0; x < 8; x++ {
+				s += b[y*8+x] * dctCos[x][u]
+			}
+			rows[y*8+u] = s
+		}
+	}
+	for u := 0; u < 8; u++ {
+		for v := 0; v < 8; v++ {
+			var s float64
+			for y := 0; y < 8; y++ {
+				s += rows[y*8+u] * dctCos[y][v]
+			}
+			b[v*8+u] = s
+		}
+	}
+	for k, n := range zigzag {
+		zz[k] = int(math.Round(b[n] / float64(q[k])))
+	}
+	return zz
+}
+
+// bitWriter writes the entropy coded data of scans, stuffing a zero byte
+// after every 0xff.
+type bitWriter struct {
+	w    *bufio.Writer
+	bits uint32
+	n    uint
+}
+
+func (bw *bitWriter) emit(bits uint32, n uint) {
+	bw.bits = bw.bits<<n | bits&(1<<n-1)
+	bw.n += n
+	for bw.n >= 8 {
+		b := byte(bw.bits >> (bw.n - 8))
+		bw.w.WriteByte(b)
+		if b == 0xff {
+			bw.w.WriteByte(0)
+		}
+		bw.n -= 8
+	}
+}
+
+func (bw *bitWriter) emitHuffman(hc *[256]huffmanCode, v byte) {
+	bw.emit(hc[v].code, hc[v].length)
+}
+
+// emitValue writes the Huffman code of the size of v, combined with the
+// preceding run of zeros for AC coefficients, followed by v.
+func (bw *bitWriter) emitValue(hc *[256]huffmanCode, run int, v int) {
+	a, bits := v, v
+	if v < 0 {
+		a, bits = -v, v-1
+	}
+	var size uint
+	for ; a > 0; a >>= 1 {
+		size++
+	}
+	bw.emitHuffman(hc, byte(run<<4)|byte(size))
+	bw.emit(uint32(bits), size)
+}
+
+// flush pads the last byte of a scan with one bits.
+func (bw *bitWriter) flush() {
+	if bw.n > 0 {
+		bw.emit(1<<(8-bw.n)-1, 8-bw.n)
+	}
+	bw.bits = 0
+}
+
+// progressiveScan encodes the coefficients from start to end of the given
+// components.
+type progressiveScan struct {
+	components []int
+	start, end int
+}
+
+var progressiveScans = []progressiveScan{
+	{[]int{0, 1, 2}, 0, 0},
+	{[]int{0}, 1, 5},
+	{[]int{1}, 1, 63},
+	{[]int{2}, 1, 63},
+	{[]int{0}, 6, 63},
+}
+
+// table returns the index of the quantization and Huffman tables of
+// component c, either luminance or chrominance.
+func table(c int) int {
+	if c == 0 {
+		return 0
+	}
+	return 1
+}
+
+// encodeProgressive writes img to w as a progressive JPEG image with the
+// given quality between 1 and 100.
+func encodeProgressive(w io.Writer, img image.Image, quality int) error {
+	b := img.Bounds()
+	if b.Dx() < 1 || b.Dy() < 1 || b.Dx() >= 1<<16 || b.Dy() >= 1<<16 {
+		return errors.New("image is too large or empty to encode as JPEG")
+	}
+
+	if quality < 1 {
+		quality = 1
+	} else if quality > 100 {
+		quality = 100
+	}
+	scale := 200 - quality*2
+	if quality < 50 {
+		scale = 5000 / quality
+	}
+	var quant [2][64]int
+	for i := range quant {
+		for k, u := range unscaledQuant[i] {
+			q := (int(u)*scale + 50) / 100
+			if q < 1 {
+				q = 1
+			} else if q > 255 {
+				q = 255
+			}
+			quant[i][k] = q
+		}
+	}
+
+	// the quantized coefficients of the blocks of Y, Cb and Cr. Chroma is
+	// subsampled by two in both directions like Go's encoder does, so each
+	// MCU of 16x16 pixels has four Y blocks and one Cb and Cr block.
+	mw, mh := (b.Dx()+15)/16, (b.Dy()+15)/16
+	stride := [3]int{2 * mw, mw, mw}
+	blocks := [3][][64]int{make([][64]int, 4*mw*mh), make([][64]int, mw*mh), make([][64]int, mw*mh)}
+	for my := 0; my < mh; my++ {
+		for mx := 0; mx < mw; mx++ {
+			var ycc [3][16][16]float64
+			for y := 0; y < 16; y++ {
+				for x := 0; x < 16; x++ {
+					// blocks are padded by repeating the last pixels
+					px, py := b.Min.X+mx*16+x, b.Min.Y+my*16+y
+					if px >= b.Max.X {
+						px = b.Max.X - 1
+					}
+					if py >= b.Max.Y {
+						py = b.Max.Y - 1
+					}
+					r, g, bl, _ := img.At(px, py).RGBA()
+					yy, cb, cr := color.RGBToYCbCr(uint8(r>>8), uint8(g>>8), uint8(bl>>8))
+					ycc[0][y][x], ycc[1][y][x], ycc[2][y][x] = float64(yy)-128, float64(cb)-128, float64(cr)-128
+				}
+			}
+
+			for i := 0; i < 4; i++ {
+				bx, by := i%2*8, i/2*8
+				var blk [64]float64
+				for y := 0; y < 8; y++ {
+					for x := 0; x < 8; x++ {
+						blk[y*8+x] = ycc[0][by+y][bx+x]
+					}
+				}
+				blocks[0][(2*my+i/2)*stride[0]+2*mx+i%2] = fdct(&blk, &quant[0])
+			}
+			for c := 1; c < 3; c++ {
+				var blk [64]float64
+				for y := 0; y < 8; y++ {
+					for x := 0; x < 8; x++ {
+						blk[y*8+x] = (ycc[c][2*y][2*x] + ycc[c][2*y][2*x+1] + ycc[c][2*y+1][2*x] + ycc[c][2*y+1][2*x+1]) / 4
+					}
+				}
+				blocks[c][my*stride[c]+mx] = fdct(&blk, &quant[1])
+			}
+		}
+	}
+
+	// scans of single components only cover the blocks of the component's
+	// size, not those that pad the last MCUs
+	cols := [3]int{(b.Dx() + 7) / 8, mw, mw}
+	rows := [3]int{(b.Dy() + 7) / 8, mh, mh}
+
+	var codes [4][256]huffmanCode
+	for i, s := range huffmanSpecs {
+		codes[i] = huffmanCodes(s)
+	}
+
+	out := bufio.NewWriter(w)
+	out.Write([]byte{0xff, 0xd8})
+
+	out.Write([]byte{0xff, 0xdb, 0, 2 + 2*65})
+	for i, q := range quant {
+		out.WriteByte(byte(i))
+		for _, v := range q {
+			out.WriteByte(byte(v))
+		}
+	}
+
+	out.Write([]byte{0xff, 0xc2, 0, 17, 8, byte(b.Dy() >> 8), byte(b.Dy()), byte(b.Dx() >> 8), byte(b.Dx()), 3})
+	out.Write([]byte{1, 0x22, 0, 2, 0x11, 1, 3, 0x11, 1})
+
+	n := 2
+	for _, s := range huffmanSpecs {
+		n += 17 + len(s.value)
+	}
+	out.Write([]byte{0xff, 0xc4, byte(n >> 8), byte(n)})
+	for i, s := range huffmanSpecs {
+		out.WriteByte(byte(i%2)<<4 | byte(i/2)) // class and table
+		out.Write(s.count[:])
+		out.Write(s.value)
+	}
+
+	bits := &bitWriter{w: out}
+	for _, s := range progressiveScans {
+		out.Write([]byte{0xff, 0xda, 0, byte(6 + 2*len(s.components)), byte(len(s.components))})
+		for _, c := range s.components {
+			t := byte(table(c))
+			out.Write([]byte{byte(c + 1), t<<4 | t})
+		}
+		out.Write([]byte{byte(s.start), byte(s.end), 0})
+
+		if s.start == 0 {
+			var pred [3]int
+			dc := func(c, i int) {
+				v := blocks[c][i][0]
+				bits.emitValue(&codes[2*table(c)], 0, v-pred[c])
+				pred[c] = v
+			}
+			for my := 0; my < mh; my++ {
+				for mx := 0; mx < mw; mx++ {
+					for i := 0; i < 4; i++ {
+						dc(0, (2*my+i/2)*stride[0]+2*mx+i%2)
+					}
+					dc(1, my*stride[1]+mx)
+					dc(2, my*stride[2]+mx)
+				}
+			}
+		} else {
+			c := s.components[0]
+			hc := &codes[2*table(c)+1]
+			for by := 0; by < rows[c]; by++ {
+				for bx := 0; bx < cols[c]; bx++ {
+					blk := &blocks[c][by*stride[c]+bx]
+					run := 0
+					for k := s.start; k <= s.end; k++ {
+						if blk[k] == 0 {
+							run++
+							continue
+						}
+						for ; run > 15; run -= 16 {
+							bits.emitHuffman(hc, 0xf0)
+						}
+						bits.emitValue(hc, run, blk[k])
+						run = 0
+					}
+					if run > 0 {
+						bits.emitHuffman(hc, 0x00)
+					}
+				}
+			}
+		}
+		bits.flush()
+	}
+
+	out.Write([]byte{0xff, 0xd9})
+	return out.Flush()
+}
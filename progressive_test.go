@@ -0,0 +1,73 @@
+package main
+
+import (
+	"bytes"
+	"image"
+	"image/color"
+	"image/jpeg"
+	"testing"
+)
+
+func TestEncodeProgressive(t *testing.T) {
+	for _, size := range []image.Point{{1, 1}, {16, 16}, {9, 40}} {
+		var buf bytes.Buffer
+		if err := encodeProgressive(&buf, image.NewGray(image.Rect(0, 0, size.X, size.Y)), 75); err != nil {
+			t.Fatalf("Size %v: %v", size, err)
+		}
+		dec, err := jpeg.Decode(&buf)
+		if err != nil {
+			t.Fatalf("Size %v: failed to decode, err=%v", size, err)
+		}
+		if dec.Bounds().Size() != size {
+			t.Errorf("Size %v: got %v", size, dec.Bounds().Size())
+		}
+	}
+
+	img := image.NewRGBA(image.Rect(0, 0, 37, 21))
+	for y := 0; y < 21; y++ {
+		for x := 0; x < 37; x++ {
+			img.Set(x, y, color.RGBA{uint8(x * 7), uint8(y * 12), uint8((x + y) * 4), 255})
+		}
+	}
+
+	for _, quality := range []int{1, 50, 75, 100} {
+		var buf bytes.Buffer
+		if err := encodeProgressive(&buf, img, quality); err != nil {
+			t.Fatalf("Quality %v: %v", quality, err)
+		}
+		if !bytes.Contains(buf.Bytes(), []byte{0xff, 0xc2}) {
+			t.Errorf("Quality %v: expected progressive frame header", quality)
+		}
+
+		dec, err := jpeg.Decode(bytes.NewReader(buf.Bytes()))
+		if err != nil {
+			t.Fatalf("Quality %v: failed to decode, err=%v", quality, err)
+		}
+		if dec.Bounds() != img.Bounds() {
+			t.Fatalf("Quality %v: expected bounds %v, got %v", quality, img.Bounds(), dec.Bounds())
+		}
+		if quality < 75 {
+			continue
+		}
+
+		var diff, n int
+		for y := 0; y < 21; y++ {
+			for x := 0; x < 37; x++ {
+				r1, g1, b1, _ := img.At(x, y).RGBA()
+				r2, g2, b2, _ := dec.At(x, y).RGBA()
+				diff += abs(int(r1>>8)-int(r2>>8)) + abs(int(g1>>8)-int(g2>>8)) + abs(int(b1>>8)-int(b2>>8))
+				n += 3
+			}
+		}
+		if avg := float64(diff) / float64(n); avg > 4 {
+			t.Errorf("Quality %v: expected decoded image to match, got average difference %.2f", quality, avg)
+		}
+	}
+}
+
+func abs(i int) int {
+	if i < 0 {
+		return -i
+	}
+	return i
+}
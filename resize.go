@@ -0,0 +1,301 @@
+package main
+
+import (
+	"container/list"
+	"crypto/sha1"
+	"encoding/hex"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/nfnt/resize"
+	"github.com/oliamb/cutter"
+)
+
+// resizePath is the path below an album's URL under which resized images
+// are served, e.g. /b/kitties/r/400x300/happy.jpg.
+const resizePath = "r"
+
+const resizedDirName = ".bilder-resized"
+
+// resizeSize is a size that images can be resized to. Images are scaled to
+// cover and cropped to both dimensions if they are set, and scaled to fit
+// the one that is set otherwise.
+type resizeSize struct {
+	Width  int
+	Height int
+}
+
+func parseResizeSize(s string) (resizeSize, error) {
+	var rs resizeSize
+	ps := strings.Split(s, "x")
+	if len(ps) != 2 {
+		return rs, fmt.Errorf("invalid size %#v, expected WxH", s)
+	}
+
+	var err error
+	if rs.Width, err = strconv.Atoi(ps[0]); err != nil || rs.Width < 0 {
+		return rs, fmt.Errorf("invalid width in size %#v", s)
+	}
+	if rs.Height, err = strconv.Atoi(ps[1]); err != nil || rs.Height < 0 {
+		return rs, fmt.Errorf("invalid height in size %#v", s)
+	}
+	if rs.Width == 0 && rs.Height == 0 {
+		return rs, fmt.Errorf("invalid size %#v, width or height needs to be set", s)
+	}
+	return rs, nil
+}
+
+func (rs resizeSize) String() string {
+	return fmt.Sprintf("%vx%v", rs.Width, rs.Height)
+}
+
+// resizeRequest returns the size and image name of a request for path p of
+// an album for a resized image, e.g. /r/400x300/happy.jpg.
+func resizeRequest(p string) (string, string, bool) {
+	ps := strings.Split(p, "/")
+	if len(ps) != 4 || ps[0] != "" || ps[1] != resizePath {
+		return "", "", false
+	}
+	return ps[2], ps[3], true
+}
+
+type resizedFile struct {
+	name string
+	size int64
+}
+
+// resizer resizes images on request to one of the allowed sizes and caches
+// the results on disk, evicting the least recently used ones once the cache
+// exceeds its budget.
+type resizer struct {
+	sync.Mutex
+	dir     string
+	budget  int64
+	sizes   map[string]resizeSize
+	used    int64
+	lru     *list.List // of *resizedFile, most recently used first
+	files   map[string]*list.Element
+	pending map[string]chan struct{}
+}
+
+func newResizer(c config) *resizer {
+	rz := &resizer{
+		dir:     resizedDir(c),
+		budget:  int64(c.ResizeCacheMB) << 20,
+		sizes:   map[string]resizeSize{},
+		lru:     list.New(),
+		files:   map[string]*list.Element{},
+		pending: map[string]chan struct{}{},
+	}
+
+	for _, s := range c.ResizeSizes {
+		rs, err := parseResizeSize(s)
+		if err != nil {
+			log.Fatalf("Failed to parse resize size, err=%v", err)
+		}
+		rz.sizes[rs.String()] = rs
+	}
+
+	if len(rz.sizes) > 0 {
+		rz.load()
+	}
+	return rz
+}
+
+func resizedDir(c config) string {
+	if c.CacheDir == "" {
+		return filepath.Join(c.BilderDir, resizedDirName)
+	}
+	return filepath.Join(c.CacheDir, "resized")
+}
+
+// load adds the files that were resized before to the cache, the most
+// recently modified first as cache hits touch them.
+func (rz *resizer) load() {
+	fs, err := ioutil.ReadDir(rz.dir)
+	if err != nil {
+		if !os.IsNotExist(err) {
+			log.Printf("Failed to read resized images in %#v, err=%v", rz.dir, err)
+		}
+		return
+	}
+
+	sort.Slice(fs, func(i, j int) bool { return fs[i].ModTime().After(fs[j].ModTime()) })
+	for _, f := range fs {
+		if f.IsDir() || filepath.Ext(f.Name()) != ".jpg" {
+			continue
+		}
+		rz.files[f.Name()] = rz.lru.PushBack(&resizedFile{name: f.Name(), size: f.Size()})
+		rz.used += f.Size()
+	}
+	rz.evict()
+}
+
+// cacheName identifies the resized version of the image at p, which changes
+// when the image is modified.
+func cacheName(p string, fi os.FileInfo, rs resizeSize) string {
+	k := fmt.Sprintf("%v %v %v %v", p, fi.Size(), fi.ModTime().UnixNano(), rs)
+	sum := sha1.Sum([]byte(k))
+	return hex.EncodeToString(sum[:]) + ".jpg"
+}
+
+// serve responds with the image at p resized to size s, resizing it first
+// if it's not cached.
+func (rz *resizer) serve(w http.ResponseWriter, r *http.Request, p, s string) {
+	rs, ok := rz.sizes[s]
+	if !ok {
+		http.Error(w, "404 page not found", 404)
+		return
+	}
+
+	fi, err := os.Stat(p)
+	if err != nil {
+		http.Error(w, "404 page not found", 404)
+		return
+	}
+
+	n := cacheName(p, fi, rs)
+	fh, err := rz.ensure(p, n, rs)
+	if err != nil {
+		log.Printf("Failed to resize %#v to %v, err=%v", p, rs, err)
+		http.Error(w, "500 internal server error", 500)
+		return
+	}
+	defer fh.Close()
+
+	w.Header().Set("Content-Type", "image/jpeg")
+	http.ServeContent(w, r, n, fi.ModTime(), fh)
+}
+
+// ensure resizes the image at p to cached file n unless it's cached, marks
+// it as recently used and opens it. It's opened while the lock is held, so
+// that it can't be evicted before it's served. Concurrent requests for the
+// same file wait for the first one to resize it. Cached files that were
+// removed by others are resized again.
+func (rz *resizer) ensure(p, n string, rs resizeSize) (*os.File, error) {
+	cp := filepath.Join(rz.dir, n)
+	for {
+		rz.Lock()
+		if e, ok := rz.files[n]; ok {
+			fh, err := os.Open(cp)
+			if os.IsNotExist(err) {
+				log.Printf("Resizing removed image %#v again.", n)
+				rz.forget(e)
+				rz.Unlock()
+				continue
+			}
+			rz.lru.MoveToFront(e)
+			rz.Unlock()
+			if err != nil {
+				return nil, err
+			}
+			now := time.Now()
+			os.Chtimes(cp, now, now)
+			return fh, nil
+		}
+		wait, ok := rz.pending[n]
+		if !ok {
+			rz.pending[n] = make(chan struct{})
+			rz.Unlock()
+			break
+		}
+		rz.Unlock()
+		<-wait
+	}
+
+	size, err := rz.resize(p, n, rs)
+
+	rz.Lock()
+	defer rz.Unlock()
+	close(rz.pending[n])
+	delete(rz.pending, n)
+	if err != nil {
+		return nil, err
+	}
+
+	fh, err := os.Open(cp)
+	if err != nil {
+		return nil, err
+	}
+	rz.files[n] = rz.lru.PushFront(&resizedFile{name: n, size: size})
+	rz.used += size
+	rz.evict()
+	return fh, nil
+}
+
+// evict removes the least recently used files while the cache exceeds its
+// budget, keeping at least the most recently used one. The lock needs to be
+// held.
+func (rz *resizer) evict() {
+	for rz.used > rz.budget && rz.lru.Len() > 1 {
+		e := rz.lru.Back()
+		f := e.Value.(*resizedFile)
+		if err := os.Remove(filepath.Join(rz.dir, f.name)); err != nil && !os.IsNotExist(err) {
+			log.Printf("Failed to remove resized image %#v, err=%v", f.name, err)
+		}
+		rz.forget(e)
+	}
+}
+
+// forget removes cached file e from the cache without removing it from
+// disk. The lock needs to be held.
+func (rz *resizer) forget(e *list.Element) {
+	f := e.Value.(*resizedFile)
+	rz.lru.Remove(e)
+	delete(rz.files, f.name)
+	rz.used -= f.size
+}
+
+// resize writes the image at p resized to rs to cached file n and returns
+// the file's size.
+func (rz *resizer) resize(p, n string, rs resizeSize) (int64, error) {
+	img, o, err := decodeImage(p)
+	if err != nil {
+		return 0, err
+	}
+
+	// scale before orienting, which is expensive for large images
+	b := img.Bounds()
+	w, h := orientedSize(b.Dx(), b.Dy(), o)
+	tw, th := rs.Width, rs.Height
+	if tw > 0 && th > 0 {
+		if w*th > h*tw {
+			tw = 0
+		} else {
+			th = 0
+		}
+	}
+	rw, rh := orientedSize(tw, th, o)
+	resized := orient(resize.Resize(uint(rw), uint(rh), img, resize.Lanczos3), o)
+
+	if rs.Width > 0 && rs.Height > 0 {
+		resized, err = cutter.Crop(resized, cutter.Config{Width: rs.Width, Height: rs.Height, Mode: cutter.Centered})
+		if err != nil {
+			return 0, err
+		}
+	}
+
+	if err := os.MkdirAll(rz.dir, 0755); err != nil {
+		return 0, err
+	}
+
+	cp := filepath.Join(rz.dir, n)
+	if err := writeJPEG(cp, resized, jpegOptions{Quality: 85}); err != nil {
+		return 0, err
+	}
+
+	fi, err := os.Stat(cp)
+	if err != nil {
+		return 0, err
+	}
+	return fi.Size(), nil
+}
@@ -1,15 +1,19 @@
 package main
 
 import (
+	"expvar"
 	"log"
 	"net/http"
+	"net/url"
 	"os"
-	"path/filepath"
+	"path"
+	"reflect"
 	"strings"
 	"sync"
+	"sync/atomic"
+	"time"
 
 	"github.com/gorilla/handlers"
-	uuid "github.com/satori/go.uuid"
 )
 
 var (
@@ -31,38 +35,76 @@ func (sf *syncFile) Write(p []byte) (n int, err error) {
 
 type server struct {
 	http.Server
-	sync.RWMutex
-	addr         string
-	albumUpdates <-chan []album
-	dir          string
-	accessLog    string
-	logFile      *syncFile
-	albums       map[string]authHandler
+	addr          string
+	urlPathPrefix string
+	albumUpdates  <-chan []album
+	layout        layout
+	accessLog     string
+	logFile       *syncFile
+	debugVars     bool
+	sessions      sessionStore
+	sessionMaxAge time.Duration
+	secureCookies bool
+	loginForm     bool
+	secret        []byte
+	limiter       *loginLimiter
+	resizer       *resizer
+	overview      bool
+	tileSize      int // of albums on the overview page
+
+	// albums holds an *albumRegistry that is replaced as a whole on album
+	// updates and never modified after being stored.
+	albums atomic.Value
+}
+
+// albumRegistry is a snapshot of the served albums.
+type albumRegistry struct {
+	albums   map[string]*authHandler
+	overview *cachedPage
 }
 
-func newServer(ad, d, al string, au <-chan []album) *server {
-	return &server{addr: ad, dir: d, accessLog: al, albumUpdates: au}
+func newServer(c config, au <-chan []album) *server {
+	c = c.withDefaults()
+	return &server{
+		addr:          c.Addr,
+		urlPathPrefix: c.URLPathPrefix,
+		layout:        layout{dir: c.BilderDir, cacheDir: c.CacheDir},
+		accessLog:     c.AccessLog,
+		debugVars:     c.DebugVars,
+		sessions:      newSessionStore(c),
+		sessionMaxAge: time.Duration(c.SessionMaxAgeHours) * time.Hour,
+		secureCookies: c.SecureCookies,
+		loginForm:     c.LoginForm,
+		secret:        []byte(c.Secret),
+		limiter:       newLoginLimiter(c),
+		resizer:       newResizer(c),
+		overview:      c.Overview,
+		tileSize:      defaultThumbSettings.merge(c.Thumbs).Size,
+		albumUpdates:  au,
+	}
 }
 
 func (s *server) ServeHTTP(w http.ResponseWriter, r *http.Request) {
 	if r.URL.Path == "" {
+		if ov := s.registry().overview; ov != nil {
+			ov.ServeHTTP(w, r)
+			return
+		}
 		http.Error(w, "404 page not found", 404)
 		return
 	}
 
-	sep := strings.Index(r.URL.Path, "/")
+	// the longest matching album, as albums can contain sub-albums
 	an := r.URL.Path
-	if sep > 0 {
-		an = r.URL.Path[:sep]
-	}
-
-	s.RLock()
-	h, ok := s.albums[an]
-	s.RUnlock()
-
-	if !ok {
-		http.Error(w, "404 page not found", 404)
-		return
+	h, ok := s.album(an)
+	for !ok {
+		sep := strings.LastIndex(an, "/")
+		if sep <= 0 {
+			http.Error(w, "404 page not found", 404)
+			return
+		}
+		an = an[:sep]
+		h, ok = s.album(an)
 	}
 
 	p := strings.TrimPrefix(r.URL.Path, an)
@@ -70,6 +112,18 @@ func (s *server) ServeHTTP(w http.ResponseWriter, r *http.Request) {
 	h.ServeHTTP(w, r)
 }
 
+func (s *server) registry() *albumRegistry {
+	if reg, ok := s.albums.Load().(*albumRegistry); ok {
+		return reg
+	}
+	return &albumRegistry{}
+}
+
+func (s *server) album(n string) (*authHandler, bool) {
+	h, ok := s.registry().albums[n]
+	return h, ok
+}
+
 func assetsHandler(w http.ResponseWriter, r *http.Request) {
 	p := r.URL.Path[len("/a/"):]
 	a, ok := assets[p]
@@ -83,73 +137,243 @@ func assetsHandler(w http.ResponseWriter, r *http.Request) {
 	w.Write(a.Content)
 }
 
+// albumFiles serves the page of an album, rendered from the album's
+// details, and only the images, videos, posters and thumbs that are part of
+// it, as well as resized versions of its images. Other files, like the
+// album's bilder.json, and directories aren't served.
+type albumFiles struct {
+	name    string
+	files   map[string]string
+	images  map[string]string // images that can be resized by name
+	details dirDetails
+	page    *cachedPage
+	resizer *resizer
+}
+
+func newAlbumFiles(l layout, a album) *albumFiles {
+	af := &albumFiles{
+		name:    a.name,
+		files:   map[string]string{},
+		images:  map[string]string{},
+		details: a.details,
+		page: newCachedPage(a.name, func() ([]byte, error) {
+			return renderPage(a.details)
+		}),
+	}
+
+	for _, id := range a.details.Images {
+		us := []string{id.Path, id.ThumbPath, id.Thumb2xPath, id.PosterPath, id.CoverPath}
+		for _, r := range id.Renditions {
+			us = append(us, r.Path)
+		}
+		for _, u := range us {
+			if u == "" {
+				continue
+			}
+			p, ok := l.filePath(a.name, u)
+			if !ok {
+				log.Printf("Unexpected path %#v in album %#v", u, a.name)
+				continue
+			}
+			af.files[strings.TrimPrefix(u, "b/"+a.name)] = p
+		}
+		if id.Type == mediaImage {
+			if p, ok := l.filePath(a.name, id.Path); ok {
+				af.images[path.Base(id.Path)] = p
+			}
+		}
+	}
+
+	return af
+}
+
+func (af *albumFiles) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	switch r.URL.Path {
+	case "", "/", "/index.html":
+		af.page.ServeHTTP(w, r)
+		return
+	}
+
+	if s, n, ok := resizeRequest(r.URL.Path); ok {
+		p, ok := af.images[n]
+		if !ok || af.resizer == nil {
+			http.Error(w, "404 page not found", 404)
+			return
+		}
+		af.resizer.serve(w, r, p, s)
+		return
+	}
+
+	p, ok := af.files[r.URL.Path]
+	if !ok {
+		http.Error(w, "404 page not found", 404)
+		return
+	}
+
+	fh, err := os.Open(p)
+	if err != nil {
+		http.Error(w, "404 page not found", 404)
+		return
+	}
+	defer fh.Close()
+
+	fi, err := fh.Stat()
+	if err != nil || fi.IsDir() {
+		http.Error(w, "404 page not found", 404)
+		return
+	}
+
+	http.ServeContent(w, r, fi.Name(), fi.ModTime(), fh)
+}
+
 type authHandler struct {
-	sync.Mutex
-	handler     http.Handler
-	name        string
-	user, pass  string
-	sessions    map[string]struct{}
-	authEnabled bool
+	files         *albumFiles
+	handler       http.Handler
+	name          string
+	urlPath       string // path of the album as requested by browsers
+	realm         string // album whose credentials this album uses
+	realmPath     string
+	creds         map[string]string
+	sessions      sessionStore
+	cookieMaxAge  time.Duration
+	secureCookies bool
+	authEnabled   bool
+	loginForm     bool
+	secret        []byte
+	revoked       map[string]bool
+	limiter       *loginLimiter
 }
 
-func (h authHandler) isAuthed(sid string) bool {
-	h.Lock()
-	_, ok := h.sessions[sid]
-	h.Unlock()
-	return ok
+// cookieName returns the name of a cookie for album a, cookies of sub-albums
+// are distinguished by their path.
+func cookieName(base, a string) string {
+	return base + url.QueryEscape(a)
 }
 
-func (h authHandler) newSession() string {
-	sid := uuid.NewV1().String()
-	h.Lock()
-	h.sessions[sid] = nada
-	h.Unlock()
-	return sid
+func (h *authHandler) cookie(v string, maxAge int) *http.Cookie {
+	return &http.Cookie{
+		Name:     cookieName(cookieBaseName, h.realm),
+		Value:    v,
+		Path:     h.realmPath,
+		MaxAge:   maxAge,
+		HttpOnly: true,
+		Secure:   h.secureCookies,
+		SameSite: http.SameSiteLaxMode,
+	}
 }
 
-func (h authHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
-	if !h.authEnabled {
-		h.handler.ServeHTTP(w, r)
+func (h *authHandler) hasSession(r *http.Request) bool {
+	cookie, err := r.Cookie(cookieName(cookieBaseName, h.realm))
+	return err == nil && cookie != nil && h.sessions.valid(h.realm, cookie.Value)
+}
+
+// startSession creates a session and sets its cookie, it responds with an
+// error and returns false if that fails.
+func (h *authHandler) startSession(w http.ResponseWriter) bool {
+	sid, err := h.sessions.create(h.realm)
+	if err != nil {
+		log.Printf("Failed to create session for album %#v, err=%v", h.name, err)
+		http.Error(w, "500 internal server error", 500)
+		return false
+	}
+
+	http.SetCookie(w, h.cookie(sid, int(h.cookieMaxAge.Seconds())))
+	return true
+}
+
+func (h *authHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	switch {
+	case r.URL.Path == "/"+logoutPath:
+		h.logout(w, r)
+		return
+	case r.URL.Path == "/"+loginPath && h.authEnabled && h.loginForm:
+		h.login(w, r)
 		return
 	}
 
-	cookie, err := r.Cookie(cookieBaseName + h.name)
-	if err == nil && cookie != nil && h.isAuthed(cookie.Value) {
+	if !h.authEnabled || h.hasSession(r) || h.shared(w, r) {
 		h.handler.ServeHTTP(w, r)
 		return
 	}
 
-	u, p, ok := r.BasicAuth()
-	if !(ok && u == h.user && p == h.pass) {
-		w.Header().Set("WWW-Authenticate", "Basic realm=\"Authorization Required\"")
-		http.Error(w, "Not Authorized", http.StatusUnauthorized)
+	// Basic Auth is supported with the login form too, for scripted access.
+	if u, p, ok := r.BasicAuth(); ok {
+		client := h.limiter.client(r)
+		if d := h.limiter.locked(client, h.realm); d > 0 {
+			tooManyLogins(w, d)
+			return
+		}
+
+		if checkCredentials(h.creds, u, p) {
+			h.limiter.succeed(client, h.realm)
+			if h.startSession(w) {
+				h.handler.ServeHTTP(w, r)
+			}
+			return
+		}
+		h.limiter.fail(client, h.realm)
+	}
+
+	if h.loginForm {
+		h.redirectToLogin(w, r)
 		return
 	}
 
-	sid := h.newSession()
-	http.SetCookie(w, &http.Cookie{Name: cookieBaseName + h.name, Value: sid, MaxAge: 0})
-	h.handler.ServeHTTP(w, r)
+	w.Header().Set("WWW-Authenticate", "Basic realm=\"Authorization Required\"")
+	http.Error(w, "Not Authorized", http.StatusUnauthorized)
+}
+
+// logout ends the visitor's session and asks the browser to forget the
+// Basic Auth credentials it cached for the album.
+func (h *authHandler) logout(w http.ResponseWriter, r *http.Request) {
+	if cookie, err := r.Cookie(cookieName(cookieBaseName, h.realm)); err == nil {
+		h.sessions.remove(cookie.Value)
+	}
+	http.SetCookie(w, h.cookie("", -1))
+	http.SetCookie(w, h.shareCookie("", -1))
+
+	switch {
+	case !h.authEnabled:
+		http.Redirect(w, r, h.urlPath+"/", http.StatusSeeOther)
+	case h.loginForm:
+		http.Redirect(w, r, h.urlPath+"/"+loginPath, http.StatusSeeOther)
+	default:
+		w.Header().Set("WWW-Authenticate", "Basic realm=\"Authorization Required\"")
+		http.Error(w, "Logged out", http.StatusUnauthorized)
+	}
 }
 
 func (s *server) listenForUpdates() {
 	for as := range s.albumUpdates {
-		s.RLock()
-		oldHandlers := s.albums
-		s.RUnlock()
-		hs := make(map[string]authHandler)
+		hs := make(map[string]*authHandler)
 		for _, a := range as {
-			oh, oldExists := oldHandlers[a.name]
-			sess := map[string]struct{}{}
-			if oldExists {
-				sess = oh.sessions
+			files := newAlbumFiles(s.layout, a)
+			files.resizer = s.resizer
+			if oh, ok := s.album(a.name); ok && reflect.DeepEqual(oh.files.details, a.details) {
+				files = oh.files // keep rendered page
+			}
+			h := &authHandler{
+				files:         files,
+				handler:       files,
+				name:          a.name,
+				creds:         a.creds,
+				urlPath:       s.urlPathPrefix + "/b/" + a.name,
+				realm:         a.realm,
+				realmPath:     s.urlPathPrefix + "/b/" + a.realm,
+				sessions:      s.sessions,
+				cookieMaxAge:  s.sessionMaxAge,
+				secureCookies: s.secureCookies,
+				authEnabled:   a.hasAuth(),
+				loginForm:     s.loginForm,
+				secret:        s.secret,
+				revoked:       map[string]bool{},
+				limiter:       s.limiter,
+			}
+			for _, id := range a.revokedTokens {
+				h.revoked[id] = true
 			}
-			h := authHandler{
-				handler:     http.FileServer(http.Dir(filepath.Join(s.dir, a.name))),
-				name:        a.name,
-				user:        a.user,
-				pass:        a.pass,
-				sessions:    sess,
-				authEnabled: a.hasAuth(),
+			if a.loginForm != nil {
+				h.loginForm = *a.loginForm
 			}
 			if s.logFile != nil {
 				h.handler = handlers.CombinedLoggingHandler(s.logFile, h.handler)
@@ -157,15 +381,19 @@ func (s *server) listenForUpdates() {
 			hs[a.name] = h
 		}
 
-		s.Lock()
-		s.albums = hs
-		s.Unlock()
+		reg := &albumRegistry{albums: hs}
+		if s.overview {
+			od := newOverview(s.urlPathPrefix, s.tileSize, as)
+			reg.overview = newCachedPage("overview", func() ([]byte, error) {
+				return renderOverview(od)
+			})
+		}
+		s.albums.Store(reg)
 	}
 }
 
 func (s *server) serve() {
-	go s.listenForUpdates()
-
+	// open the access log before handlers for albums that use it are created
 	if s.accessLog != "" {
 		lf, err := os.OpenFile(s.accessLog, os.O_WRONLY|os.O_CREATE, 0644)
 		if err != nil {
@@ -176,6 +404,8 @@ func (s *server) serve() {
 		}
 	}
 
+	go s.listenForUpdates()
+
 	mux := http.NewServeMux()
 	if len(assets) == 0 {
 		log.Printf("Serving assets for assets directory.")
@@ -187,6 +417,10 @@ func (s *server) serve() {
 
 	mux.Handle("/b/", http.StripPrefix("/b/", s))
 
+	if s.debugVars {
+		mux.Handle("/debug/vars", expvar.Handler())
+	}
+
 	s.Addr = s.addr
 	s.Handler = mux
 
@@ -0,0 +1,901 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"html"
+	"image"
+	"image/jpeg"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"path/filepath"
+	"reflect"
+	"regexp"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+func writeTestFiles(t *testing.T, dir string, fs map[string]string) {
+	for n, c := range fs {
+		p := filepath.Join(dir, filepath.FromSlash(n))
+		if err := os.MkdirAll(filepath.Dir(p), 0755); err != nil {
+			t.Fatal(err)
+		}
+		if err := ioutil.WriteFile(p, []byte(c), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+}
+
+func serveAlbumFile(h http.Handler, p string) *httptest.ResponseRecorder {
+	rec := httptest.NewRecorder()
+	h.ServeHTTP(rec, httptest.NewRequest("GET", "http://localhost"+p, nil))
+	return rec
+}
+
+func TestAlbumFilesInPlace(t *testing.T) {
+	dir := testDir(t)
+
+	writeTestFiles(t, dir, map[string]string{
+		"kitties/cat.jpg":                            "cat",
+		"kitties/cat_thumb.jpg":                      "thumb",
+		"kitties/cat_thumb2x.jpg":                    "photo",
+		"kitties/cat_1600.jpg":                       "photo",
+		".bilder-renditions/kitties/cat_thumb2x.jpg": "thumb2x",
+		".bilder-renditions/kitties/cat_1600.jpg":    "display",
+		".bilder-renditions/kitties/cat_2560.jpg":    "unused",
+		".bilder-renditions/kitties/cat_cover.jpg":   "cover",
+		"kitties/clip.mp4":                           "clip",
+		"kitties/clip_poster.jpg":                    "poster",
+		"kitties/bilder.json":                        `{"user": "u", "pass": "p"}`,
+		"kitties/index.html":                         "stale",
+		"kitties/unknown.jpg":                        "unknown",
+		"kitties/.hidden.jpg":                        "hidden",
+		"kitties/sub/dog.jpg":                        "dog",
+		"kitties/notes.txt":                          "notes",
+		"other/secret.jpg":                           "secret",
+		"kitties/sub/.bilder.json":                   "{}",
+	})
+
+	a := album{
+		name: "kitties",
+		details: dirDetails{
+			Title: "Kitties",
+			Images: []*imgDetails{
+				{
+					Type:        mediaImage,
+					Path:        "b/kitties/cat.jpg",
+					ThumbPath:   "b/kitties/cat_thumb.jpg",
+					Thumb2xPath: "b/kitties/_thumbs/cat_thumb2x.jpg",
+					Renditions:  []rendition{{Width: 1600, Height: 1200, Path: "b/kitties/_thumbs/cat_1600.jpg"}},
+					CoverPath:   "b/kitties/_thumbs/cat_cover.jpg",
+				},
+				{Type: mediaVideo, Path: "b/kitties/clip.mp4", PosterPath: "b/kitties/clip_poster.jpg"},
+			},
+		},
+	}
+	h := newAlbumFiles(layout{dir: dir}, a)
+
+	tests := []struct {
+		path   string
+		status int
+		body   string
+	}{
+		{"/cat.jpg", 200, "cat"},
+		{"/cat_thumb.jpg", 200, "thumb"},
+		{"/cat_thumb2x.jpg", 404, ""},
+		{"/cat_1600.jpg", 404, ""},
+		{"/_thumbs/cat_thumb2x.jpg", 200, "thumb2x"},
+		{"/_thumbs/cat_1600.jpg", 200, "display"},
+		{"/_thumbs/cat_2560.jpg", 404, ""},
+		{"/clip.mp4", 200, "clip"},
+		{"/clip_poster.jpg", 200, "poster"},
+		{"/bilder.json", 404, ""},
+		{"/BILDER.JSON", 404, ""},
+		{"/unknown.jpg", 404, ""},
+		{"/.hidden.jpg", 404, ""},
+		{"/sub", 404, ""},
+		{"/sub/", 404, ""},
+		{"/sub/dog.jpg", 404, ""},
+		{"/sub/.bilder.json", 404, ""},
+		{"/notes.txt", 404, ""},
+		{"/../other/secret.jpg", 404, ""},
+		{"/_thumbs/cat_thumb.jpg", 404, ""},
+		{"/_thumbs/cat_cover.jpg", 200, "cover"},
+	}
+
+	for _, tt := range tests {
+		rec := serveAlbumFile(h, tt.path)
+		if rec.Code != tt.status {
+			t.Errorf("GET %v: expected status %v, got %v", tt.path, tt.status, rec.Code)
+			continue
+		}
+		if tt.body != "" && rec.Body.String() != tt.body {
+			t.Errorf("GET %v: expected body %#v, got %#v", tt.path, tt.body, rec.Body.String())
+		}
+	}
+
+	for _, p := range []string{"", "/", "/index.html"} {
+		rec := serveAlbumFile(h, p)
+		if rec.Code != 200 {
+			t.Errorf("GET %#v: expected status 200, got %v", p, rec.Code)
+			continue
+		}
+		if rec.Body.String() == "stale" {
+			t.Errorf("GET %#v: expected rendered page, got index.html from disk", p)
+		}
+	}
+
+	body := serveAlbumFile(h, "/").Body.String()
+	if s := `srcset="/b/kitties/_thumbs/cat_thumb2x.jpg 2x"`; !strings.Contains(body, s) {
+		t.Errorf("Expected page to contain %v", s)
+	}
+	expected := []pageRendition{{Src: "/b/kitties/_thumbs/cat_1600.jpg", W: 1600, H: 1200}}
+	if actual := pageRenditions(t, body); !reflect.DeepEqual(actual, [][]pageRendition{expected}) {
+		t.Errorf("Expected renditions %#v, got %#v", expected, actual)
+	}
+}
+
+type pageRendition struct {
+	Src  string
+	W, H int
+}
+
+var renditionsAttrRegexp = regexp.MustCompile(`data-renditions="([^"]*)"`)
+
+// pageRenditions returns the renditions of the images on the album page
+// body, as the viewer reads them.
+func pageRenditions(t *testing.T, body string) [][]pageRendition {
+	var rss [][]pageRendition
+	for _, m := range renditionsAttrRegexp.FindAllStringSubmatch(body, -1) {
+		var rs []pageRendition
+		if err := json.Unmarshal([]byte(html.UnescapeString(m[1])), &rs); err != nil {
+			t.Fatalf("Failed to parse renditions %#v, err=%v", m[1], err)
+		}
+		rss = append(rss, rs)
+	}
+	return rss
+}
+
+func TestPageRenditionsOfNamesWithSpaces(t *testing.T) {
+	dd := dirDetails{
+		URLPathPrefix: "/bilder",
+		Title:         "Screenshots",
+		Thumbs:        defaultThumbSettings,
+		Images: []*imgDetails{{
+			Type:      mediaImage,
+			Path:      "b/shots/Screenshot 2024-06-01 at 10.00, #2.png",
+			ThumbPath: "b/shots/Screenshot 2024-06-01 at 10.00, #2_png_thumb.jpg",
+			Renditions: []rendition{
+				{Width: 1600, Height: 900, Path: "b/shots/_thumbs/Screenshot 2024-06-01 at 10.00, #2_png_1600.jpg"},
+				{Width: 2560, Height: 1440, Path: "b/shots/_thumbs/Screenshot 2024-06-01 at 10.00, #2_png_2560.jpg"},
+			},
+		}},
+	}
+
+	byts, err := renderPage(dd)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	expected := [][]pageRendition{{
+		{Src: "/bilder/b/shots/_thumbs/Screenshot%202024-06-01%20at%2010.00,%20%232_png_1600.jpg", W: 1600, H: 900},
+		{Src: "/bilder/b/shots/_thumbs/Screenshot%202024-06-01%20at%2010.00,%20%232_png_2560.jpg", W: 2560, H: 1440},
+	}}
+	if actual := pageRenditions(t, string(byts)); !reflect.DeepEqual(actual, expected) {
+		t.Errorf("Expected renditions %#v, got %#v", expected, actual)
+	}
+}
+
+func TestAlbumFilesCacheDir(t *testing.T) {
+	dir := testDir(t)
+
+	writeTestFiles(t, dir, map[string]string{
+		"bilder/kitties/cat.jpg":             "cat",
+		"bilder/kitties/bilder.json":         "{}",
+		"cache/thumbs/kitties/cat_thumb.jpg": "thumb",
+		"cache/thumbs/kitties/old_thumb.jpg": "old",
+		"cache/thumbs/kitties/cat_cover.jpg": "cover",
+		"cache/.bilder-index.gob":            "index",
+	})
+
+	l := layout{dir: filepath.Join(dir, "bilder"), cacheDir: filepath.Join(dir, "cache")}
+	cat := &imgDetails{
+		Type:      mediaImage,
+		Path:      "b/kitties/cat.jpg",
+		ThumbPath: l.thumbURL("kitties", "cat_thumb.jpg"),
+		CoverPath: l.thumbURL("kitties", "cat_cover.jpg"),
+	}
+	a := album{
+		name: "kitties",
+		details: dirDetails{
+			PublicURL: "https://example.com",
+			Images:    []*imgDetails{cat},
+			Cover:     cat,
+		},
+	}
+	h := newAlbumFiles(l, a)
+
+	tests := []struct {
+		path   string
+		status int
+		body   string
+	}{
+		{"/cat.jpg", 200, "cat"},
+		{"/_thumbs/cat_thumb.jpg", 200, "thumb"},
+		{"/_thumbs/cat_cover.jpg", 200, "cover"},
+		{"/_thumbs/old_thumb.jpg", 404, ""},
+		{"/_thumbs/", 404, ""},
+		{"/_thumbs/../../.bilder-index.gob", 404, ""},
+		{"/cat_thumb.jpg", 404, ""},
+		{"/bilder.json", 404, ""},
+	}
+
+	for _, tt := range tests {
+		rec := serveAlbumFile(h, tt.path)
+		if rec.Code != tt.status {
+			t.Errorf("GET %v: expected status %v, got %v", tt.path, tt.status, rec.Code)
+			continue
+		}
+		if tt.body != "" && rec.Body.String() != tt.body {
+			t.Errorf("GET %v: expected body %#v, got %#v", tt.path, tt.body, rec.Body.String())
+		}
+	}
+
+	og := `<meta property="og:image" content="https://example.com/b/kitties/_thumbs/cat_cover.jpg">`
+	if body := serveAlbumFile(h, "/").Body.String(); !strings.Contains(body, og) {
+		t.Errorf("Expected page to contain cover as preview image, got %v", body)
+	}
+}
+
+func TestServerDoesNotServeAlbumConfig(t *testing.T) {
+	dir := testDir(t)
+
+	writeTestFiles(t, dir, map[string]string{
+		"kitties/cat.jpg":     "cat",
+		"kitties/bilder.json": `{"user": "u", "pass": "p"}`,
+	})
+
+	au := make(chan []album, 1)
+	s := newServer(config{BilderDir: dir}, au)
+	au <- []album{{
+		name:  "kitties",
+		realm: "kitties",
+		creds: map[string]string{"u": "p"},
+		details: dirDetails{
+			Images: []*imgDetails{{Type: mediaImage, Path: "b/kitties/cat.jpg"}},
+		},
+	}}
+	close(au)
+	s.listenForUpdates()
+
+	h := http.StripPrefix("/b/", s)
+	for p, status := range map[string]int{
+		"/b/kitties/cat.jpg":     200,
+		"/b/kitties/bilder.json": 404,
+		"/b/kitties/":            200,
+	} {
+		req := httptest.NewRequest("GET", "http://localhost"+p, nil)
+		req.SetBasicAuth("u", "p")
+		rec := httptest.NewRecorder()
+		h.ServeHTTP(rec, req)
+		if rec.Code != status {
+			t.Errorf("GET %v: expected status %v, got %v", p, status, rec.Code)
+		}
+	}
+}
+
+// updateAlbums passes as to the server like the watcher does, and returns
+// once the server's albums are replaced.
+func updateAlbums(s *server, as ...album) {
+	au := make(chan []album, 1)
+	au <- as
+	close(au)
+	s.albumUpdates = au
+	s.listenForUpdates()
+}
+
+func testAlbum(caption string) album {
+	return album{
+		name:  "kitties",
+		realm: "kitties",
+		creds: map[string]string{"u": "p"},
+		details: dirDetails{
+			Images: []*imgDetails{{Type: mediaImage, Path: "b/kitties/cat.jpg", Caption: caption}},
+		},
+	}
+}
+
+func login(h http.Handler, user, pass string) *httptest.ResponseRecorder {
+	req := httptest.NewRequest("GET", "http://localhost/b/kitties/", nil)
+	req.SetBasicAuth(user, pass)
+	rec := httptest.NewRecorder()
+	h.ServeHTTP(rec, req)
+	return rec
+}
+
+func getWithCookies(h http.Handler, p string, cs []*http.Cookie) *httptest.ResponseRecorder {
+	req := httptest.NewRequest("GET", "http://localhost"+p, nil)
+	for _, c := range cs {
+		req.AddCookie(c)
+	}
+	rec := httptest.NewRecorder()
+	h.ServeHTTP(rec, req)
+	return rec
+}
+
+func TestConcurrentLoginsDuringReloads(t *testing.T) {
+	dir := testDir(t)
+
+	writeTestFiles(t, dir, map[string]string{"kitties/cat.jpg": "cat"})
+
+	s := newServer(config{
+		BilderDir:          dir,
+		SessionFile:        filepath.Join(dir, "sessions.gob"),
+		LoginAlbumAttempts: 1000, // more than the failed logins below
+	}, nil)
+	updateAlbums(s, testAlbum("initial"))
+	h := http.StripPrefix("/b/", s)
+
+	var wg sync.WaitGroup
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		for i := 0; i < 50; i++ {
+			updateAlbums(s, testAlbum(fmt.Sprintf("caption %v", i)))
+		}
+	}()
+
+	for c := 0; c < 8; c++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for i := 0; i < 20; i++ {
+				rec := login(h, "u", "p")
+				if rec.Code != 200 {
+					t.Errorf("Expected successful login, got status %v", rec.Code)
+					return
+				}
+
+				cs := rec.Result().Cookies()
+				if len(cs) != 1 {
+					t.Errorf("Expected session cookie, got %v", cs)
+					return
+				}
+
+				if rec := getWithCookies(h, "/b/kitties/cat.jpg", cs); rec.Code != 200 {
+					t.Errorf("Expected session to be valid, got status %v", rec.Code)
+				}
+
+				if rec := login(h, "u", "wrong"); rec.Code != 401 {
+					t.Errorf("Expected failed login, got status %v", rec.Code)
+				}
+			}
+		}()
+	}
+
+	wg.Wait()
+}
+
+func TestSessionsSurviveAlbumReloads(t *testing.T) {
+	dir := testDir(t)
+
+	writeTestFiles(t, dir, map[string]string{"kitties/cat.jpg": "cat"})
+
+	s := newServer(config{BilderDir: dir}, nil)
+	updateAlbums(s, testAlbum("before"))
+	h := http.StripPrefix("/b/", s)
+
+	rec := login(h, "u", "p")
+	if rec.Code != 200 {
+		t.Fatalf("Expected successful login, got status %v", rec.Code)
+	}
+	cs := rec.Result().Cookies()
+
+	updateAlbums(s, testAlbum("after"))
+	if rec := getWithCookies(h, "/b/kitties/cat.jpg", cs); rec.Code != 200 {
+		t.Errorf("Expected session to be valid after reload, got status %v", rec.Code)
+	}
+
+	if rec := getWithCookies(h, "/b/kitties/logout", cs); rec.Code != 401 {
+		t.Errorf("Expected logout to ask for credentials, got status %v", rec.Code)
+	}
+	if rec := getWithCookies(h, "/b/kitties/cat.jpg", cs); rec.Code != 401 {
+		t.Errorf("Expected session to end on logout, got status %v", rec.Code)
+	}
+}
+
+func TestLoginForm(t *testing.T) {
+	dir := testDir(t)
+
+	writeTestFiles(t, dir, map[string]string{"kitties/cat.jpg": "cat"})
+
+	s := newServer(config{
+		BilderDir:     dir,
+		URLPathPrefix: "/bilder",
+		LoginForm:     true,
+	}, nil)
+	updateAlbums(s, testAlbum(""))
+	h := http.StripPrefix("/b/", s)
+
+	rec := getWithCookies(h, "/b/kitties/cat.jpg", nil)
+	if rec.Code != http.StatusSeeOther {
+		t.Fatalf("Expected redirect to login form, got status %v", rec.Code)
+	}
+	if l := rec.Header().Get("Location"); l != "/bilder/b/kitties/login?next=%2Fbilder%2Fb%2Fkitties%2Fcat.jpg" {
+		t.Errorf("Unexpected login location %#v", l)
+	}
+
+	rec = getWithCookies(h, "/b/kitties/login?next=/bilder/b/kitties/cat.jpg", nil)
+	if rec.Code != 200 {
+		t.Fatalf("Expected login form, got status %v", rec.Code)
+	}
+	csrf := rec.Result().Cookies()
+	if len(csrf) != 1 || !strings.Contains(rec.Body.String(), csrf[0].Value) {
+		t.Fatalf("Expected CSRF token in cookie and form, got cookies %v", csrf)
+	}
+
+	post := func(form url.Values, cs []*http.Cookie) *httptest.ResponseRecorder {
+		req := httptest.NewRequest("POST", "http://localhost/b/kitties/login", strings.NewReader(form.Encode()))
+		req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+		for _, c := range cs {
+			req.AddCookie(c)
+		}
+		rec := httptest.NewRecorder()
+		h.ServeHTTP(rec, req)
+		return rec
+	}
+
+	tests := []struct {
+		name     string
+		form     url.Values
+		cookies  []*http.Cookie
+		status   int
+		location string
+	}{
+		{
+			name:    "missing CSRF cookie",
+			form:    url.Values{"user": {"u"}, "pass": {"p"}, "csrf": {csrf[0].Value}},
+			cookies: nil,
+			status:  http.StatusForbidden,
+		},
+		{
+			name:    "wrong CSRF token",
+			form:    url.Values{"user": {"u"}, "pass": {"p"}, "csrf": {"nope"}},
+			cookies: csrf,
+			status:  http.StatusForbidden,
+		},
+		{
+			name:    "wrong password",
+			form:    url.Values{"user": {"u"}, "pass": {"wrong"}, "csrf": {csrf[0].Value}},
+			cookies: csrf,
+			status:  http.StatusUnauthorized,
+		},
+		{
+			name:     "redirect outside of album",
+			form:     url.Values{"user": {"u"}, "pass": {"p"}, "csrf": {csrf[0].Value}, "next": {"//evil.example/"}},
+			cookies:  csrf,
+			status:   http.StatusSeeOther,
+			location: "/bilder/b/kitties/",
+		},
+		{
+			name:     "redirect to requested image",
+			form:     url.Values{"user": {"u"}, "pass": {"p"}, "csrf": {csrf[0].Value}, "next": {"/bilder/b/kitties/#&gid=1&pid=1"}},
+			cookies:  csrf,
+			status:   http.StatusSeeOther,
+			location: "/bilder/b/kitties/#&gid=1&pid=1",
+		},
+	}
+
+	for _, tt := range tests {
+		rec := post(tt.form, tt.cookies)
+		if rec.Code != tt.status {
+			t.Errorf("%v: expected status %v, got %v", tt.name, tt.status, rec.Code)
+			continue
+		}
+		if tt.location == "" {
+			continue
+		}
+		if l := rec.Header().Get("Location"); l != tt.location {
+			t.Errorf("%v: expected location %#v, got %#v", tt.name, tt.location, l)
+		}
+
+		var sess []*http.Cookie
+		for _, c := range rec.Result().Cookies() {
+			if c.Name == cookieBaseName+"kitties" {
+				sess = append(sess, c)
+			}
+		}
+		if rec := getWithCookies(h, "/b/kitties/cat.jpg", sess); rec.Code != 200 {
+			t.Errorf("%v: expected session to be valid, got status %v", tt.name, rec.Code)
+		}
+	}
+
+	if rec := login(h, "u", "p"); rec.Code != 200 {
+		t.Errorf("Expected Basic Auth to keep working, got status %v", rec.Code)
+	}
+}
+
+func TestShareTokens(t *testing.T) {
+	dir := testDir(t)
+
+	writeTestFiles(t, dir, map[string]string{"kitties/cat.jpg": "cat", "kitties/dog.jpg": "dog"})
+
+	secret := []byte("secret")
+	s := newServer(config{BilderDir: dir, Secret: string(secret)}, nil)
+	a := testAlbum("")
+	a.details.Images = append(a.details.Images, &imgDetails{Type: mediaImage, Path: "b/kitties/dog.jpg"})
+	a.revokedTokens = []string{"revoked"}
+	updateAlbums(s, a)
+	h := http.StripPrefix("/b/", s)
+
+	sign := func(st shareToken, secret []byte) string {
+		tk, err := st.sign(secret)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return url.QueryEscape(tk)
+	}
+	later := time.Now().Add(time.Hour).Unix()
+	album := sign(shareToken{ID: "album", Album: "kitties", Expires: later}, secret)
+	image := sign(shareToken{ID: "image", Album: "kitties", Image: "cat.jpg", Expires: later}, secret)
+
+	tests := []struct {
+		path   string
+		status int
+	}{
+		{"/b/kitties/?t=" + album, 200},
+		{"/b/kitties/dog.jpg?t=" + album, 200},
+		{"/b/kitties/cat.jpg?t=" + image, 200},
+		{"/b/kitties/dog.jpg?t=" + image, 401},
+		{"/b/kitties/?t=" + image, 401},
+		{"/b/kitties/?t=" + sign(shareToken{ID: "other", Album: "other", Expires: later}, secret), 401},
+		{"/b/kitties/?t=" + sign(shareToken{ID: "expired", Album: "kitties", Expires: time.Now().Add(-time.Hour).Unix()}, secret), 401},
+		{"/b/kitties/?t=" + sign(shareToken{ID: "revoked", Album: "kitties", Expires: later}, secret), 401},
+		{"/b/kitties/?t=" + sign(shareToken{ID: "forged", Album: "kitties", Expires: later}, []byte("guessed")), 401},
+	}
+
+	for _, tt := range tests {
+		rec := getWithCookies(h, tt.path, nil)
+		if rec.Code != tt.status {
+			t.Errorf("GET %v: expected status %v, got %v", tt.path, tt.status, rec.Code)
+		}
+	}
+
+	rec := getWithCookies(h, "/b/kitties/?t="+album, nil)
+	cs := rec.Result().Cookies()
+	if rec := getWithCookies(h, "/b/kitties/dog.jpg", cs); rec.Code != 200 {
+		t.Errorf("Expected album token cookie to grant access, got status %v", rec.Code)
+	}
+}
+
+func TestLoginLockout(t *testing.T) {
+	dir := testDir(t)
+
+	writeTestFiles(t, dir, map[string]string{"kitties/cat.jpg": "cat"})
+
+	s := newServer(config{
+		BilderDir:           dir,
+		LoginAttempts:       2,
+		LoginLockoutSeconds: 60,
+		TrustedProxies:      []string{"192.0.2.1", "10.0.0.0/8"},
+	}, nil)
+	updateAlbums(s, testAlbum(""))
+	h := http.StripPrefix("/b/", s)
+
+	loginFrom := func(remote, forwarded, pass string) *httptest.ResponseRecorder {
+		req := httptest.NewRequest("GET", "http://localhost/b/kitties/", nil)
+		req.RemoteAddr = remote
+		if forwarded != "" {
+			req.Header.Set("X-Forwarded-For", forwarded)
+		}
+		req.SetBasicAuth("u", pass)
+		rec := httptest.NewRecorder()
+		h.ServeHTTP(rec, req)
+		return rec
+	}
+
+	tests := []struct {
+		name      string
+		remote    string
+		forwarded string
+		pass      string
+		status    int
+	}{
+		{"first failure", "192.0.2.1:1234", "203.0.113.1, 10.0.0.2", "wrong", 401},
+		{"second failure", "192.0.2.1:1234", "203.0.113.1", "wrong", 401},
+		{"locked out", "192.0.2.1:1234", "203.0.113.1", "p", 429},
+		{"other client", "192.0.2.1:1234", "203.0.113.2", "p", 200},
+		{"spoofed header from untrusted client", "198.51.100.1:1234", "203.0.113.1", "p", 200},
+		{"spoofed header via trusted proxy", "192.0.2.1:1234", "203.0.113.1, 203.0.113.3", "p", 200},
+	}
+
+	for _, tt := range tests {
+		rec := loginFrom(tt.remote, tt.forwarded, tt.pass)
+		if rec.Code != tt.status {
+			t.Errorf("%v: expected status %v, got %v", tt.name, tt.status, rec.Code)
+		}
+		if tt.status == 429 && rec.Header().Get("Retry-After") == "" {
+			t.Errorf("%v: expected Retry-After header", tt.name)
+		}
+	}
+}
+
+func TestLoginAlbumLockout(t *testing.T) {
+	dir := testDir(t)
+	writeTestFiles(t, dir, map[string]string{"kitties/cat.jpg": "cat"})
+
+	s := newServer(config{BilderDir: dir, LoginAttempts: 2, LoginAlbumAttempts: 3}, nil)
+	updateAlbums(s, testAlbum(""), album{name: "puppies", realm: "puppies", creds: map[string]string{"u": "p"}})
+	h := http.StripPrefix("/b/", s)
+
+	loginFrom := func(remote, a, pass string) int {
+		req := httptest.NewRequest("GET", "http://localhost/b/"+a+"/", nil)
+		req.RemoteAddr = remote
+		req.SetBasicAuth("u", pass)
+		rec := httptest.NewRecorder()
+		h.ServeHTTP(rec, req)
+		return rec.Code
+	}
+
+	tests := []struct {
+		name   string
+		remote string
+		album  string
+		pass   string
+		status int
+	}{
+		{"first client", "203.0.113.1:1234", "kitties", "wrong", 401},
+		{"second client", "203.0.113.2:1234", "kitties", "wrong", 401},
+		{"successful login", "203.0.113.3:1234", "kitties", "p", 200},
+		{"third client", "203.0.113.3:1234", "kitties", "wrong", 401},
+		{"locked out album", "203.0.113.4:1234", "kitties", "p", 429},
+		{"other album", "203.0.113.4:1234", "puppies", "p", 200},
+	}
+	for _, tt := range tests {
+		if actual := loginFrom(tt.remote, tt.album, tt.pass); actual != tt.status {
+			t.Errorf("%v: expected status %v, got %v", tt.name, tt.status, actual)
+		}
+	}
+}
+
+func TestOverview(t *testing.T) {
+	dir := testDir(t)
+
+	listed := true
+	albums := []album{
+		{name: "public", details: dirDetails{Title: "Public Album", Images: []*imgDetails{{Type: mediaImage, Path: "b/public/a.jpg", ThumbPath: "b/public/a_thumb.jpg"}}}},
+		{name: "hidden", realm: "hidden", creds: map[string]string{"u": "p"}, details: dirDetails{Title: "Hidden Album"}},
+		{name: "locked", realm: "locked", creds: map[string]string{"u": "p"}, listed: &listed, details: dirDetails{
+			Title:  "Locked Album",
+			Images: []*imgDetails{{Type: mediaImage, Path: "b/locked/secret.jpg", ThumbPath: "b/locked/secret_thumb.jpg"}},
+		}},
+	}
+
+	s := newServer(config{BilderDir: dir}, nil)
+	updateAlbums(s, albums...)
+	if rec := getWithCookies(http.StripPrefix("/b/", s), "/b/", nil); rec.Code != 404 {
+		t.Errorf("Expected no overview unless enabled, got status %v", rec.Code)
+	}
+
+	s = newServer(config{BilderDir: dir, Overview: true}, nil)
+	updateAlbums(s, albums...)
+	rec := getWithCookies(http.StripPrefix("/b/", s), "/b/", nil)
+	if rec.Code != 200 {
+		t.Fatalf("Expected overview, got status %v", rec.Code)
+	}
+
+	body := rec.Body.String()
+	for _, s := range []string{"Public Album", "b/public/a_thumb.jpg", "1 image", "Locked Album"} {
+		if !strings.Contains(body, s) {
+			t.Errorf("Expected overview to contain %#v", s)
+		}
+	}
+	for _, s := range []string{"Hidden Album", "secret_thumb.jpg"} {
+		if strings.Contains(body, s) {
+			t.Errorf("Expected overview not to contain %#v", s)
+		}
+	}
+}
+
+func TestNestedAlbums(t *testing.T) {
+	dir := testDir(t)
+
+	creds := map[string]string{"u": "p"}
+	s := newServer(config{BilderDir: dir}, nil)
+	updateAlbums(s,
+		album{name: "2024", realm: "2024", creds: creds},
+		album{name: "2024/beach", realm: "2024", creds: creds, details: dirDetails{
+			Images: []*imgDetails{{Type: mediaImage, Path: "b/2024/beach/sea.jpg"}},
+		}},
+		album{name: "2024/private", realm: "2024/private", creds: map[string]string{"v": "q"}},
+	)
+	h := http.StripPrefix("/b/", s)
+
+	for _, p := range []string{"/b/2024/", "/b/2024/beach/", "/b/2024/beach/sea.jpg"} {
+		if rec := getWithCookies(h, p, nil); rec.Code != http.StatusUnauthorized {
+			t.Errorf("Expected %v to require login, got status %v", p, rec.Code)
+		}
+	}
+
+	req := httptest.NewRequest("GET", "http://localhost/b/2024/", nil)
+	req.SetBasicAuth("u", "p")
+	rec := httptest.NewRecorder()
+	h.ServeHTTP(rec, req)
+	if rec.Code != 200 {
+		t.Fatalf("Expected login to succeed, got status %v", rec.Code)
+	}
+	cs := rec.Result().Cookies()
+	if len(cs) != 1 || cs[0].Path != "/b/2024" {
+		t.Fatalf("Expected session cookie for the parent album, got %v", cs)
+	}
+
+	if rec := getWithCookies(h, "/b/2024/beach/", cs); rec.Code != 200 {
+		t.Errorf("Expected session to grant access to sub-album, got status %v", rec.Code)
+	}
+	if rec := getWithCookies(h, "/b/2024/private/", cs); rec.Code != http.StatusUnauthorized {
+		t.Errorf("Expected sub-album with own credentials to require login, got status %v", rec.Code)
+	}
+	if rec := getWithCookies(h, "/b/2024/nope/", cs); rec.Code != 404 {
+		t.Errorf("Expected unknown path in album to be not found, got status %v", rec.Code)
+	}
+}
+
+// testDir returns a temporary directory that is removed after the test.
+func testDir(t *testing.T) string {
+	dir, err := ioutil.TempDir("", "bilder-test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { os.RemoveAll(dir) })
+	return dir
+}
+
+func writeTestImage(t *testing.T, p string, w, h int) {
+	if err := os.MkdirAll(filepath.Dir(p), 0755); err != nil {
+		t.Fatal(err)
+	}
+	fh, err := os.Create(p)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer fh.Close()
+	if err := jpeg.Encode(fh, image.NewRGBA(image.Rect(0, 0, w, h)), nil); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestResizeImages(t *testing.T) {
+	dir := testDir(t)
+
+	writeTestImage(t, filepath.Join(dir, "bilder", "kitties", "cat.jpg"), 300, 200)
+	c := config{
+		BilderDir:     filepath.Join(dir, "bilder"),
+		CacheDir:      filepath.Join(dir, "cache"),
+		ResizeSizes:   []string{"100x100", "60x0"},
+		ResizeCacheMB: 1,
+	}
+	s := newServer(c, nil)
+	updateAlbums(s, testAlbum(""))
+	h := http.StripPrefix("/b/", s)
+
+	if rec := getWithCookies(h, "/b/kitties/r/100x100/cat.jpg", nil); rec.Code != http.StatusUnauthorized {
+		t.Fatalf("Expected resized image to require login, got status %v", rec.Code)
+	}
+	cs := login(h, "u", "p").Result().Cookies()
+
+	tests := []struct {
+		path          string
+		status        int
+		width, height int
+	}{
+		{"/b/kitties/r/100x100/cat.jpg", 200, 100, 100},
+		{"/b/kitties/r/60x0/cat.jpg", 200, 60, 40},
+		{"/b/kitties/r/100x100/cat.jpg", 200, 100, 100},
+		{"/b/kitties/r/300x300/cat.jpg", 404, 0, 0},
+		{"/b/kitties/r/100x100/dog.jpg", 404, 0, 0},
+		{"/b/kitties/r/100x100/../cat.jpg", 404, 0, 0},
+	}
+	for _, tt := range tests {
+		rec := getWithCookies(h, tt.path, cs)
+		if rec.Code != tt.status {
+			t.Errorf("GET %v: expected status %v, got %v", tt.path, tt.status, rec.Code)
+			continue
+		}
+		if tt.status != 200 {
+			continue
+		}
+		ic, err := jpeg.DecodeConfig(rec.Body)
+		if err != nil {
+			t.Errorf("GET %v: failed to decode resized image, err=%v", tt.path, err)
+			continue
+		}
+		if ic.Width != tt.width || ic.Height != tt.height {
+			t.Errorf("GET %v: expected %vx%v, got %vx%v", tt.path, tt.width, tt.height, ic.Width, ic.Height)
+		}
+	}
+
+	fs, err := ioutil.ReadDir(filepath.Join(dir, "cache", "resized"))
+	if err != nil || len(fs) != 2 {
+		t.Fatalf("Expected two cached images, got %v, err=%v", len(fs), err)
+	}
+
+	// only the most recently used image fits the budget
+	s.resizer.Lock()
+	s.resizer.budget = 1
+	s.resizer.evict()
+	s.resizer.Unlock()
+	fs, err = ioutil.ReadDir(filepath.Join(dir, "cache", "resized"))
+	if err != nil || len(fs) != 1 {
+		t.Fatalf("Expected one cached image after eviction, got %v, err=%v", len(fs), err)
+	}
+	if rec := getWithCookies(h, "/b/kitties/r/60x0/cat.jpg", cs); rec.Code != 200 {
+		t.Errorf("Expected evicted image to be resized again, got status %v", rec.Code)
+	}
+}
+
+func TestResizeKeepsServedImagesReadable(t *testing.T) {
+	dir := testDir(t)
+
+	cat, dog := filepath.Join(dir, "bilder", "cat.jpg"), filepath.Join(dir, "bilder", "dog.jpg")
+	writeTestImage(t, cat, 300, 200)
+	writeTestImage(t, dog, 300, 200)
+	rz := newResizer(config{BilderDir: filepath.Join(dir, "bilder"), ResizeSizes: []string{"100x100"}, ResizeCacheMB: 1})
+	rz.budget = 1 // only the most recently used image is kept
+
+	rs := rz.sizes["100x100"]
+	fh, err := rz.ensure(cat, "cat.jpg", rs)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer fh.Close()
+
+	// resizing another image evicts the one that's being served
+	dfh, err := rz.ensure(dog, "dog.jpg", rs)
+	if err != nil {
+		t.Fatal(err)
+	}
+	dfh.Close()
+	if _, ok := rz.files["cat.jpg"]; ok {
+		t.Fatalf("Expected cat.jpg to be evicted")
+	}
+
+	if _, err := jpeg.DecodeConfig(fh); err != nil {
+		t.Errorf("Expected evicted image to be readable while it's served, err=%v", err)
+	}
+}
+
+func TestResizeRecreatesRemovedImages(t *testing.T) {
+	dir := testDir(t)
+
+	cat := filepath.Join(dir, "bilder", "cat.jpg")
+	writeTestImage(t, cat, 300, 200)
+	rz := newResizer(config{BilderDir: filepath.Join(dir, "bilder"), ResizeSizes: []string{"100x100"}, ResizeCacheMB: 1})
+
+	rs := rz.sizes["100x100"]
+	fh, err := rz.ensure(cat, "cat.jpg", rs)
+	if err != nil {
+		t.Fatal(err)
+	}
+	fh.Close()
+	if err := os.Remove(filepath.Join(rz.dir, "cat.jpg")); err != nil {
+		t.Fatal(err)
+	}
+
+	fh, err = rz.ensure(cat, "cat.jpg", rs)
+	if err != nil {
+		t.Fatalf("Expected removed image to be resized again, err=%v", err)
+	}
+	defer fh.Close()
+	if ic, err := jpeg.DecodeConfig(fh); err != nil || ic.Width != 100 || ic.Height != 100 {
+		t.Errorf("Expected 100x100 image, got %vx%v err=%v", ic.Width, ic.Height, err)
+	}
+	if rz.lru.Len() != 1 {
+		t.Errorf("Expected one cached image, got %v", rz.lru.Len())
+	}
+}
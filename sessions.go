@@ -0,0 +1,240 @@
+package main
+
+import (
+	"crypto/rand"
+	"encoding/base64"
+	"encoding/gob"
+	"io/ioutil"
+	"log"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+)
+
+// sessionTouchInterval is how often the last use of a session is updated,
+// so that the file store isn't written on every request.
+const sessionTouchInterval = time.Minute
+
+// session is the login of a visitor to an album.
+type session struct {
+	Album    string
+	Created  time.Time
+	LastSeen time.Time
+}
+
+// sessionStore keeps track of the sessions of logged in visitors.
+type sessionStore interface {
+	// create starts a new session for album a and returns its ID.
+	create(a string) (string, error)
+
+	// valid reports whether id is a live session for album a and marks it
+	// as used.
+	valid(a, id string) bool
+
+	// remove ends session id.
+	remove(id string)
+}
+
+func newSessionStore(c config) sessionStore {
+	idle := time.Duration(c.SessionIdleTimeoutHours) * time.Hour
+	maxAge := time.Duration(c.SessionMaxAgeHours) * time.Hour
+	if c.SessionFile == "" {
+		return newMemorySessions(idle, maxAge)
+	}
+	return loadFileSessions(c.SessionFile, idle, maxAge)
+}
+
+func newSessionID() (string, error) {
+	b := make([]byte, 32)
+	if _, err := rand.Read(b); err != nil {
+		return "", err
+	}
+	return base64.RawURLEncoding.EncodeToString(b), nil
+}
+
+// memorySessions keeps sessions in memory, they are lost on restart.
+type memorySessions struct {
+	sync.Mutex
+	idle     time.Duration
+	maxAge   time.Duration
+	sessions map[string]session
+	now      func() time.Time // replaced by tests
+}
+
+func newMemorySessions(idle, maxAge time.Duration) *memorySessions {
+	return &memorySessions{
+		idle:     idle,
+		maxAge:   maxAge,
+		sessions: map[string]session{},
+		now:      time.Now,
+	}
+}
+
+func (ms *memorySessions) expired(s session, now time.Time) bool {
+	return now.Sub(s.LastSeen) > ms.idle || now.Sub(s.Created) > ms.maxAge
+}
+
+// sweep removes expired sessions, the lock needs to be held.
+func (ms *memorySessions) sweep(now time.Time) {
+	for id, s := range ms.sessions {
+		if ms.expired(s, now) {
+			delete(ms.sessions, id)
+		}
+	}
+}
+
+func (ms *memorySessions) create(a string) (string, error) {
+	id, err := newSessionID()
+	if err != nil {
+		return "", err
+	}
+
+	now := ms.now()
+	ms.Lock()
+	ms.sweep(now)
+	ms.sessions[id] = session{Album: a, Created: now, LastSeen: now}
+	ms.Unlock()
+
+	return id, nil
+}
+
+func (ms *memorySessions) valid(a, id string) bool {
+	ok, _ := ms.touch(a, id)
+	return ok
+}
+
+// touch reports whether id is a live session for album a, and whether its
+// last use was updated.
+func (ms *memorySessions) touch(a, id string) (bool, bool) {
+	now := ms.now()
+	ms.Lock()
+	defer ms.Unlock()
+
+	s, ok := ms.sessions[id]
+	if !ok || s.Album != a {
+		return false, false
+	}
+
+	if ms.expired(s, now) {
+		delete(ms.sessions, id)
+		return false, true
+	}
+
+	if now.Sub(s.LastSeen) < sessionTouchInterval {
+		return true, false
+	}
+
+	s.LastSeen = now
+	ms.sessions[id] = s
+	return true, true
+}
+
+func (ms *memorySessions) remove(id string) {
+	ms.Lock()
+	delete(ms.sessions, id)
+	ms.Unlock()
+}
+
+// fileSessions keeps sessions in memory and writes them to a file on
+// change, so that visitors stay logged in when bilder restarts.
+type fileSessions struct {
+	*memorySessions
+	path string
+	save sync.Mutex
+}
+
+func loadFileSessions(p string, idle, maxAge time.Duration) *fileSessions {
+	fs := &fileSessions{memorySessions: newMemorySessions(idle, maxAge), path: p}
+	fs.load()
+	return fs
+}
+
+// load adds the sessions in the file that haven't expired.
+func (fs *fileSessions) load() {
+	fh, err := os.Open(fs.path)
+	if err != nil {
+		if !os.IsNotExist(err) {
+			log.Printf("Failed to open session file %#v, err=%v", fs.path, err)
+		}
+		return
+	}
+	defer fh.Close()
+
+	var ss map[string]session
+	if err := gob.NewDecoder(fh).Decode(&ss); err != nil {
+		log.Printf("Failed to decode session file %#v, starting without sessions, err=%v", fs.path, err)
+		return
+	}
+
+	now := fs.now()
+	fs.Lock()
+	for id, s := range ss {
+		if !fs.expired(s, now) {
+			fs.sessions[id] = s
+		}
+	}
+	n := len(fs.sessions)
+	fs.Unlock()
+
+	log.Printf("Loaded %v sessions from %#v.", n, fs.path)
+}
+
+func (fs *fileSessions) create(a string) (string, error) {
+	id, err := fs.memorySessions.create(a)
+	if err != nil {
+		return "", err
+	}
+	fs.write()
+	return id, nil
+}
+
+func (fs *fileSessions) valid(a, id string) bool {
+	ok, changed := fs.touch(a, id)
+	if changed {
+		fs.write()
+	}
+	return ok
+}
+
+func (fs *fileSessions) remove(id string) {
+	fs.memorySessions.remove(id)
+	fs.write()
+}
+
+func (fs *fileSessions) write() {
+	fs.save.Lock()
+	defer fs.save.Unlock()
+
+	fs.Lock()
+	ss := make(map[string]session, len(fs.sessions))
+	for id, s := range fs.sessions {
+		ss[id] = s
+	}
+	fs.Unlock()
+
+	fh, err := ioutil.TempFile(filepath.Dir(fs.path), filepath.Base(fs.path)+".tmp")
+	if err != nil {
+		log.Printf("Failed to create temporary session file, err=%v", err)
+		return
+	}
+	tp := fh.Name()
+
+	if err := gob.NewEncoder(fh).Encode(ss); err != nil {
+		log.Printf("Failed to encode sessions, err=%v", err)
+		fh.Close()
+		os.Remove(tp)
+		return
+	}
+
+	if err := fh.Close(); err != nil {
+		log.Printf("Failed to write sessions %#v, err=%v", tp, err)
+		os.Remove(tp)
+		return
+	}
+
+	if err := os.Rename(tp, fs.path); err != nil {
+		log.Printf("Failed to replace session file %#v, err=%v", fs.path, err)
+		os.Remove(tp)
+	}
+}
@@ -0,0 +1,119 @@
+package main
+
+import (
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+type testClock struct{ t time.Time }
+
+func (c *testClock) now() time.Time { return c.t }
+
+func TestMemorySessionsExpiry(t *testing.T) {
+	clock := &testClock{t: time.Date(2024, 6, 1, 12, 0, 0, 0, time.UTC)}
+	start := clock.t
+	ms := newMemorySessions(time.Hour, 3*time.Hour)
+	ms.now = clock.now
+
+	idle, err := ms.create("kitties")
+	if err != nil {
+		t.Fatal(err)
+	}
+	active, err := ms.create("kitties")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for _, tt := range []struct {
+		after    time.Duration
+		id       string
+		album    string
+		expected bool
+	}{
+		{0, idle, "puppies", false},
+		{50 * time.Minute, idle, "kitties", true},
+		{50 * time.Minute, active, "kitties", true},
+		{105 * time.Minute, idle, "kitties", true}, // idle for 55m since last use
+		{100 * time.Minute, active, "kitties", true},
+		{150 * time.Minute, active, "kitties", true},
+		{170 * time.Minute, idle, "kitties", false},   // idle for 65m
+		{105 * time.Minute, idle, "kitties", false},   // removed once expired
+		{190 * time.Minute, active, "kitties", false}, // older than 3h
+	} {
+		clock.t = start.Add(tt.after)
+		if actual := ms.valid(tt.album, tt.id); actual != tt.expected {
+			t.Errorf("After %v: expected session valid=%v for %#v, got %v", tt.after, tt.expected, tt.album, actual)
+		}
+	}
+}
+
+func TestMemorySessionsTouch(t *testing.T) {
+	clock := &testClock{t: time.Date(2024, 6, 1, 12, 0, 0, 0, time.UTC)}
+	ms := newMemorySessions(time.Hour, 24*time.Hour)
+	ms.now = clock.now
+
+	id, err := ms.create("kitties")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	clock.t = clock.t.Add(30 * time.Second)
+	if ok, changed := ms.touch("kitties", id); !ok || changed {
+		t.Errorf("Expected valid session without update within touch interval, got ok=%v changed=%v", ok, changed)
+	}
+
+	clock.t = clock.t.Add(sessionTouchInterval)
+	if ok, changed := ms.touch("kitties", id); !ok || !changed {
+		t.Errorf("Expected valid session with update after touch interval, got ok=%v changed=%v", ok, changed)
+	}
+	if !ms.sessions[id].LastSeen.Equal(clock.t) {
+		t.Errorf("Expected last use %v, got %v", clock.t, ms.sessions[id].LastSeen)
+	}
+}
+
+func TestFileSessionsReload(t *testing.T) {
+	dir := testDir(t)
+
+	p := filepath.Join(dir, "sessions")
+	clock := &testClock{t: time.Date(2024, 6, 1, 12, 0, 0, 0, time.UTC)}
+	load := func() *fileSessions {
+		fs := &fileSessions{memorySessions: newMemorySessions(time.Hour, 24*time.Hour), path: p}
+		fs.now = clock.now
+		fs.load()
+		return fs
+	}
+
+	fs := load()
+	kept, err := fs.create("kitties")
+	if err != nil {
+		t.Fatal(err)
+	}
+	removed, err := fs.create("kitties")
+	if err != nil {
+		t.Fatal(err)
+	}
+	fs.remove(removed)
+
+	// the last use is written on touch, so that idle sessions expire
+	clock.t = clock.t.Add(50 * time.Minute)
+	if !fs.valid("kitties", kept) {
+		t.Fatalf("Expected session to be valid before reload")
+	}
+
+	clock.t = clock.t.Add(50 * time.Minute)
+	fs = load()
+	if !fs.valid("kitties", kept) {
+		t.Errorf("Expected session to be valid after reload")
+	}
+	if fs.valid("kitties", removed) {
+		t.Errorf("Expected removed session to be invalid after reload")
+	}
+
+	// expired sessions aren't loaded
+	clock.t = clock.t.Add(2 * time.Hour)
+	fs = load()
+	if len(fs.sessions) != 0 {
+		t.Errorf("Expected expired sessions to be dropped on load, got %v", len(fs.sessions))
+	}
+}
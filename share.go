@@ -0,0 +1,198 @@
+package main
+
+import (
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"log"
+	"net/http"
+	"net/url"
+	"os"
+	"strings"
+	"time"
+)
+
+var shareCookieBaseName = "share-a2bb9-"
+
+// shareToken grants access to an album, or a single image of it if Image
+// is set, until it expires. Tokens are signed with the server's secret.
+type shareToken struct {
+	ID      string `json:"id"`
+	Album   string `json:"a"`
+	Image   string `json:"i,omitempty"`
+	Expires int64  `json:"e"`
+}
+
+func newShareToken(album, image string, expires time.Time) (shareToken, error) {
+	b := make([]byte, 8)
+	if _, err := rand.Read(b); err != nil {
+		return shareToken{}, err
+	}
+	return shareToken{ID: hex.EncodeToString(b), Album: album, Image: image, Expires: expires.Unix()}, nil
+}
+
+func shareSignature(secret []byte, p string) string {
+	m := hmac.New(sha256.New, secret)
+	m.Write([]byte(p))
+	return base64.RawURLEncoding.EncodeToString(m.Sum(nil))
+}
+
+// sign encodes the token as payload.signature, both base64 encoded.
+func (st shareToken) sign(secret []byte) (string, error) {
+	byts, err := json.Marshal(st)
+	if err != nil {
+		return "", err
+	}
+	p := base64.RawURLEncoding.EncodeToString(byts)
+	return p + "." + shareSignature(secret, p), nil
+}
+
+func parseShareToken(secret []byte, t string) (shareToken, error) {
+	var st shareToken
+	ps := strings.Split(t, ".")
+	if len(ps) != 2 {
+		return st, errors.New("malformed token")
+	}
+
+	if !hmac.Equal([]byte(ps[1]), []byte(shareSignature(secret, ps[0]))) {
+		return st, errors.New("invalid signature")
+	}
+
+	byts, err := base64.RawURLEncoding.DecodeString(ps[0])
+	if err != nil {
+		return st, err
+	}
+	if err := json.Unmarshal(byts, &st); err != nil {
+		return st, err
+	}
+
+	if time.Now().After(time.Unix(st.Expires, 0)) {
+		return st, errors.New("expired token")
+	}
+
+	return st, nil
+}
+
+func (st shareToken) path(urlPathPrefix string) string {
+	p := urlPathPrefix + "/b/" + st.Album + "/"
+	if st.Image != "" {
+		p += st.Image
+	}
+	return p
+}
+
+// shared reports whether r carries a valid share token for the requested
+// file, either in the t parameter or, for album tokens, in a cookie which is
+// set when the album is first opened via a link.
+func (h *authHandler) shared(w http.ResponseWriter, r *http.Request) bool {
+	if len(h.secret) == 0 {
+		return false
+	}
+
+	if t := r.URL.Query().Get("t"); t != "" {
+		st, ok := h.validShareToken(t)
+		switch {
+		case ok && st.Image == "":
+			http.SetCookie(w, h.shareCookie(t, int(time.Until(time.Unix(st.Expires, 0)).Seconds())))
+			return true
+		case ok && st.Album == h.name && sharedImage(r.URL.Path) == st.Image:
+			return true
+		}
+	}
+
+	c, err := r.Cookie(cookieName(shareCookieBaseName, h.realm))
+	if err != nil || c.Value == "" {
+		return false
+	}
+	st, ok := h.validShareToken(c.Value)
+	return ok && st.Image == ""
+}
+
+// sharedImage returns the name of the image that is served under path p of
+// an album, either as is or resized.
+func sharedImage(p string) string {
+	if _, n, ok := resizeRequest(p); ok {
+		return n
+	}
+	return strings.TrimPrefix(p, "/")
+}
+
+// sharedBy reports whether a token for album a grants access to this album,
+// which it does for a itself and its sub-albums that use the same
+// credentials.
+func (h *authHandler) sharedBy(a string) bool {
+	if h.name == a {
+		return true
+	}
+	return strings.HasPrefix(h.name, a+"/") && (a == h.realm || strings.HasPrefix(a, h.realm+"/"))
+}
+
+func (h *authHandler) validShareToken(t string) (shareToken, bool) {
+	st, err := parseShareToken(h.secret, t)
+	if err != nil {
+		log.Printf("Rejecting share token for album %#v, err=%v", h.name, err)
+		return st, false
+	}
+	if !h.sharedBy(st.Album) {
+		log.Printf("Rejecting share token %v for album %#v in album %#v.", st.ID, st.Album, h.name)
+		return st, false
+	}
+	if h.revoked[st.ID] {
+		log.Printf("Rejecting revoked share token %v for album %#v.", st.ID, h.name)
+		return st, false
+	}
+	return st, true
+}
+
+func (h *authHandler) shareCookie(v string, maxAge int) *http.Cookie {
+	return &http.Cookie{
+		Name:     cookieName(shareCookieBaseName, h.realm),
+		Value:    v,
+		Path:     h.realmPath,
+		MaxAge:   maxAge,
+		HttpOnly: true,
+		Secure:   h.secureCookies,
+		SameSite: http.SameSiteLaxMode,
+	}
+}
+
+// shareCommand implements `bilder share` which prints a link that grants
+// access to an album or image until it expires.
+func shareCommand(args []string) {
+	fs := flag.NewFlagSet("share", flag.ExitOnError)
+	cf := fs.String("config", "", "JSON config file for bilder.")
+	album := fs.String("album", "", "Name of the album to share.")
+	image := fs.String("image", "", "File name of a single image of the album to share.")
+	expires := fs.Duration("expires", 7*24*time.Hour, "Duration until the link expires.")
+	fs.Parse(args)
+
+	c := mustReadConfig(*cf)
+	switch {
+	case c.Secret == "":
+		log.Fatalf("Sharing requires the secret option in the config.")
+	case *album == "":
+		log.Fatalf("Missing album to share.")
+	case *expires <= 0:
+		log.Fatalf("Invalid expiry %v.", *expires)
+	}
+
+	st, err := newShareToken(*album, *image, time.Now().Add(*expires))
+	if err != nil {
+		log.Fatalf("Failed to create share token, err=%v", err)
+	}
+
+	t, err := st.sign([]byte(c.Secret))
+	if err != nil {
+		log.Fatalf("Failed to sign share token, err=%v", err)
+	}
+
+	fmt.Fprintf(os.Stderr, "Token %v expires %v, revoke it by adding its ID to revoked-tokens in the album's bilder.json.\n", st.ID, time.Unix(st.Expires, 0).Format(time.RFC3339))
+	u := url.URL{Path: st.path(c.URLPathPrefix), RawQuery: url.Values{"t": {t}}.Encode()}
+	fmt.Println(u.String())
+}
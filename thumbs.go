@@ -0,0 +1,502 @@
+package main
+
+import (
+	"bytes"
+	"errors"
+	"expvar"
+	"fmt"
+	"image"
+	_ "image/gif"
+	"image/jpeg"
+	_ "image/png"
+	"io/ioutil"
+	"log"
+	"math"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+
+	"github.com/nfnt/resize"
+	"github.com/oliamb/cutter"
+	_ "golang.org/x/image/webp"
+)
+
+// thumbJob generates the thumb of an image or video with the given
+// settings, or its cover if cover is set.
+type thumbJob struct {
+	album, name string
+	poster      string
+	cover       bool
+	settings    thumbSettings
+}
+
+type thumbResult struct {
+	album, name string
+	settings    thumbSettings
+	thumb       string
+	thumb2x     string
+	display     []rendition // with file names as paths
+	cover       string
+	poster      string
+	extracted   bool // whether the poster was extracted via ffmpeg
+	err         error
+}
+
+// rendition is a version of an image that is scaled to fit displays of a
+// certain size.
+type rendition struct {
+	Width  int
+	Height int
+	Path   string
+}
+
+type thumbProgress struct {
+	Queued int
+	Done   int
+	Failed int
+}
+
+// thumbnailer generates thumbs on a fixed number of workers, independent of
+// the watcher's scans. Finished jobs are reported on results.
+type thumbnailer struct {
+	sync.Mutex
+	layout   layout
+	workers  int
+	ffmpeg   string
+	sizes    []int // long edges of display renditions, ascending
+	settings thumbSettings
+	cond     *sync.Cond
+	queue    []thumbJob
+	pending  map[thumbJob]struct{}
+	progress map[string]*thumbProgress
+	results  chan thumbResult
+}
+
+func newThumbnailer(l layout, ws int, ff string, ds []int, ts thumbSettings) *thumbnailer {
+	t := &thumbnailer{
+		layout:   l,
+		workers:  ws,
+		ffmpeg:   ff,
+		settings: defaultThumbSettings.merge(ts),
+		pending:  map[thumbJob]struct{}{},
+		progress: map[string]*thumbProgress{},
+		results:  make(chan thumbResult),
+	}
+	t.cond = sync.NewCond(&t.Mutex)
+	warnThumbSettings("config", ts)
+
+	for _, s := range ds {
+		if s <= t.settings.Size*2 {
+			log.Printf("Ignoring display size %v, it needs to be larger than %v.", s, t.settings.Size*2)
+			continue
+		}
+		t.sizes = append(t.sizes, s)
+	}
+	sort.Ints(t.sizes)
+	return t
+}
+
+func (t *thumbnailer) start() {
+	expvar.Publish("thumbs", expvar.Func(t.vars))
+	for i := 0; i < t.workers; i++ {
+		go t.work()
+	}
+}
+
+func (t *thumbnailer) enqueue(d, n, poster string, cover bool, ts thumbSettings) {
+	j := thumbJob{album: d, name: n, poster: poster, cover: cover, settings: ts}
+	t.Lock()
+	defer t.Unlock()
+
+	if _, ok := t.pending[j]; ok {
+		return
+	}
+	t.pending[j] = nada
+	t.queue = append(t.queue, j)
+
+	p, ok := t.progress[d]
+	if !ok {
+		p = &thumbProgress{}
+		t.progress[d] = p
+	}
+	p.Queued++
+	t.cond.Signal()
+}
+
+func (t *thumbnailer) next() thumbJob {
+	t.Lock()
+	defer t.Unlock()
+
+	for len(t.queue) == 0 {
+		t.cond.Wait()
+	}
+	j := t.queue[0]
+	t.queue = t.queue[1:]
+	delete(t.pending, j)
+	return j
+}
+
+func (t *thumbnailer) work() {
+	for {
+		j := t.next()
+		r := thumbResult{album: j.album, name: j.name, settings: j.settings, poster: j.poster}
+		switch {
+		case j.cover:
+			r.cover, r.err = t.generateCover(j.album, j.name, j.poster)
+		default:
+			if videoRegexp.MatchString(j.name) && r.poster == "" {
+				r.poster, r.err = t.extractPoster(j.album, j.name)
+				r.extracted = r.err == nil
+			}
+			if r.err == nil {
+				r.err = t.generateThumbs(&r)
+			}
+		}
+		t.finished(j, r.err)
+		t.results <- r
+	}
+}
+
+func (t *thumbnailer) finished(j thumbJob, err error) {
+	t.Lock()
+	defer t.Unlock()
+
+	p := t.progress[j.album]
+	if err != nil {
+		p.Failed++
+	} else {
+		p.Done++
+	}
+
+	switch {
+	case p.Done+p.Failed == p.Queued:
+		log.Printf("Finished thumbs for %#v, generated %v, failed %v.", j.album, p.Done, p.Failed)
+		delete(t.progress, j.album)
+	case (p.Done+p.Failed)%100 == 0:
+		log.Printf("Generated %v of %v thumbs for %#v.", p.Done+p.Failed, p.Queued, j.album)
+	}
+}
+
+// vars exports the progress of albums with outstanding thumbs via expvar.
+func (t *thumbnailer) vars() interface{} {
+	t.Lock()
+	defer t.Unlock()
+
+	ps := map[string]thumbProgress{}
+	for a, p := range t.progress {
+		ps[a] = *p
+	}
+	return ps
+}
+
+// thumbName returns the name of the thumb for image or video n. Thumbs are
+// always JPEG images, for other formats the original's extension becomes
+// part of the name, e.g. the thumb of a.png is a_png_thumb.jpg.
+func thumbName(n string) string {
+	return generatedName(n, "thumb")
+}
+
+// thumb2xName returns the name of the thumb of image or video n for
+// displays with twice the pixel density.
+func thumb2xName(n string) string {
+	return generatedName(n, "thumb2x")
+}
+
+// displayName returns the name of the rendition of image n with long edge
+// s, e.g. a_1600.jpg.
+func displayName(n string, s int) string {
+	return generatedName(n, strconv.Itoa(s))
+}
+
+// coverName returns the name of the cover rendition of image or video n,
+// named like its thumb.
+func coverName(n string) string {
+	return generatedName(n, "cover")
+}
+
+func generatedName(n, kind string) string {
+	ending := strings.TrimPrefix(filepath.Ext(n), ".")
+	base := strings.TrimSuffix(n, filepath.Ext(n))
+	switch strings.ToLower(ending) {
+	case "jpg", "jpeg":
+		return base + "_" + kind + "." + ending
+	}
+	return base + "_" + strings.ToLower(ending) + "_" + kind + ".jpg"
+}
+
+// extractPoster uses ffmpeg to extract a representative frame of video n as
+// its poster and returns the poster's path. It's written to a hidden
+// temporary file first, so that neither the watcher nor the garbage
+// collection pick up an incomplete poster.
+func (t *thumbnailer) extractPoster(d, n string) (string, error) {
+	vp := filepath.Join(t.layout.albumDir(d), n)
+	td := t.layout.thumbDir(d)
+	if err := os.MkdirAll(td, 0755); err != nil {
+		return "", err
+	}
+	pp := filepath.Join(td, strings.TrimSuffix(n, filepath.Ext(n))+"_poster.jpg")
+	tp := filepath.Join(td, "."+filepath.Base(pp)+".tmp")
+
+	cmd := exec.Command(t.ffmpeg, "-y", "-loglevel", "error", "-i", vp, "-vf", "thumbnail", "-frames:v", "1", "-f", "mjpeg", tp)
+	if out, err := cmd.CombinedOutput(); err != nil {
+		os.Remove(tp)
+		return "", fmt.Errorf("ffmpeg failed: %v %s", err, bytes.TrimSpace(out))
+	}
+
+	if err := os.Rename(tp, pp); err != nil {
+		os.Remove(tp)
+		return "", err
+	}
+
+	log.Printf("Extracted poster %v\n", pp)
+	return pp, nil
+}
+
+// displaySizes returns the long edges of the renditions of image n with the
+// given displayed dimensions. Images aren't scaled up, and animated GIFs
+// are always shown as they are.
+func (t *thumbnailer) displaySizes(n string, w, h int) []int {
+	if !imageRegexp.MatchString(n) || strings.EqualFold(filepath.Ext(n), ".gif") {
+		return nil
+	}
+
+	var ss []int
+	for _, s := range t.sizes {
+		if s < w || s < h {
+			ss = append(ss, s)
+		}
+	}
+	return ss
+}
+
+// displaySize returns the dimensions of the rendition with long edge s of a
+// w by h image.
+func displaySize(w, h, s int) (int, int) {
+	if w >= h {
+		return s, int(math.Round(float64(h) * float64(s) / float64(w)))
+	}
+	return int(math.Round(float64(w) * float64(s) / float64(h))), s
+}
+
+// decodeImage decodes the image at p along with its EXIF orientation.
+func decodeImage(p string) (image.Image, int, error) {
+	fh, err := os.Open(p)
+	if err != nil {
+		return nil, 0, err
+	}
+	defer fh.Close()
+
+	img, _, err := image.Decode(fh)
+	if err != nil {
+		return nil, 0, err
+	}
+
+	if _, err := fh.Seek(0, 0); err != nil {
+		log.Printf("Failed to reset reader for %#v, err=%v", p, err)
+		return img, 1, nil
+	}
+	return img, readOrientation(fh), nil
+}
+
+// jpegOptions determine how generated images are encoded. Go's encoder only
+// writes baseline images, progressive ones are written by
+// encodeProgressive.
+type jpegOptions struct {
+	Quality     int
+	Progressive bool
+}
+
+// writeJPEG encodes img to a temporary file next to p and renames it to p
+// once complete, so that p is never a partially written image, e.g. when
+// bilder is stopped while encoding. Temporary files are hidden, so that the
+// watcher ignores them.
+func writeJPEG(p string, img image.Image, o jpegOptions) error {
+	fh, err := ioutil.TempFile(filepath.Dir(p), "."+filepath.Base(p)+".tmp")
+	if err != nil {
+		return err
+	}
+	tp := fh.Name()
+
+	// temporary files are only readable by their owner
+	if err := fh.Chmod(0644); err != nil {
+		fh.Close()
+		os.Remove(tp)
+		return err
+	}
+	if o.Progressive {
+		err = encodeProgressive(fh, img, o.Quality)
+	} else {
+		err = jpeg.Encode(fh, img, &jpeg.Options{Quality: o.Quality})
+	}
+	if err != nil {
+		fh.Close()
+		os.Remove(tp)
+		return err
+	}
+	if err := fh.Close(); err != nil {
+		os.Remove(tp)
+		return err
+	}
+
+	if err := os.Rename(tp, p); err != nil {
+		os.Remove(tp)
+		return err
+	}
+	return nil
+}
+
+// checkJPEG returns an error if the file at p isn't a complete JPEG image,
+// which generated images could be if they were written by earlier versions
+// of bilder that were interrupted.
+func checkJPEG(p string) error {
+	fh, err := os.Open(p)
+	if err != nil {
+		return err
+	}
+	defer fh.Close()
+
+	fi, err := fh.Stat()
+	if err != nil {
+		return err
+	}
+	if _, err := jpeg.DecodeConfig(fh); err != nil {
+		return err
+	}
+
+	// encoders end images with an end of image marker
+	end := make([]byte, 2)
+	if _, err := fh.ReadAt(end, fi.Size()-2); err != nil {
+		return err
+	}
+	if end[0] != 0xff || end[1] != 0xd9 {
+		return errors.New("truncated image")
+	}
+	return nil
+}
+
+// thumbImage scales img to a thumb with the given settings, scale times
+// their size for displays with a higher pixel density, after orienting it
+// upright. Square thumbs are cropped to their centre.
+func thumbImage(img image.Image, o int, ts thumbSettings, scale int) (image.Image, error) {
+	b := img.Bounds()
+	w, h := orientedSize(b.Dx(), b.Dy(), o)
+	tw, th := ts.dimensions(w, h)
+	tw, th = tw*scale, th*scale
+
+	f := resizeFilters[ts.Filter]
+	if ts.Aspect == aspectPreserve {
+		rw, rh := orientedSize(tw, th, o)
+		return orient(resize.Resize(uint(rw), uint(rh), img, f), o), nil
+	}
+
+	var resized image.Image
+	if b.Dx() < b.Dy() {
+		resized = resize.Resize(uint(tw), 0, img, f)
+	} else {
+		resized = resize.Resize(0, uint(th), img, f)
+	}
+
+	return cutter.Crop(
+		orient(resized, o),
+		cutter.Config{Width: tw, Height: th, Mode: cutter.Centered},
+	)
+}
+
+// generateThumbs generates the thumbs of the result's image, or of its
+// poster image for videos, and the display renditions of images.
+func (t *thumbnailer) generateThumbs(r *thumbResult) error {
+	p := filepath.Join(t.layout.albumDir(r.album), r.name)
+	if r.poster != "" {
+		p = r.poster
+	}
+
+	img, o, err := decodeImage(p)
+	if err != nil {
+		return err
+	}
+
+	// only thumbs are stored next to the images without cache directory
+	td, rd := t.layout.thumbDir(r.album), t.layout.renditionDir(r.album)
+	for _, d := range []string{td, rd} {
+		if err := os.MkdirAll(d, 0755); err != nil {
+			return err
+		}
+	}
+
+	for _, th := range []struct {
+		name  *string
+		dir   string
+		n     string
+		scale int
+	}{
+		{&r.thumb, td, thumbName(r.name), 1},
+		{&r.thumb2x, rd, thumb2xName(r.name), 2},
+	} {
+		thumb, err := thumbImage(img, o, r.settings, th.scale)
+		if err != nil {
+			return err
+		}
+		tp := filepath.Join(th.dir, th.n)
+		if err := writeJPEG(tp, thumb, jpegOptions{Quality: r.settings.Quality, Progressive: r.settings.Progressive}); err != nil {
+			return err
+		}
+		*th.name = th.n
+	}
+	log.Printf("Generated thumb %v\n", filepath.Join(td, r.thumb))
+
+	b := img.Bounds()
+	w, h := orientedSize(b.Dx(), b.Dy(), o)
+	for _, s := range t.displaySizes(r.name, w, h) {
+		dw, dh := displaySize(w, h, s)
+		rw, rh := orientedSize(dw, dh, o)
+		resized := orient(resize.Resize(uint(rw), uint(rh), img, resize.Lanczos3), o)
+
+		dn := displayName(r.name, s)
+		if err := writeJPEG(filepath.Join(rd, dn), resized, jpegOptions{Quality: 85}); err != nil {
+			return err
+		}
+		r.display = append(r.display, rendition{Width: dw, Height: dh, Path: dn})
+	}
+	if len(r.display) > 0 {
+		log.Printf("Generated %v display renditions of %v\n", len(r.display), p)
+	}
+
+	return nil
+}
+
+// coverSize is the maximum width and height of covers, large enough for
+// link previews.
+const coverSize = 1200
+
+// generateCover generates the cover rendition of image n, or of the poster
+// image at the given path for videos. Covers keep the image's aspect ratio
+// and aren't scaled up.
+func (t *thumbnailer) generateCover(d, n, poster string) (string, error) {
+	p := filepath.Join(t.layout.albumDir(d), n)
+	if poster != "" {
+		p = poster
+	}
+
+	img, o, err := decodeImage(p)
+	if err != nil {
+		return "", err
+	}
+	cover := orient(resize.Thumbnail(coverSize, coverSize, img, resize.Lanczos3), o)
+
+	cd := t.layout.renditionDir(d)
+	if err := os.MkdirAll(cd, 0755); err != nil {
+		return "", err
+	}
+	cn := coverName(n)
+	cp := filepath.Join(cd, cn)
+	if err := writeJPEG(cp, cover, jpegOptions{Quality: 85}); err != nil {
+		return "", err
+	}
+
+	log.Printf("Generated cover %v\n", cp)
+	return cn, nil
+}
@@ -0,0 +1,152 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"log"
+	"math"
+	"sort"
+	"strings"
+
+	"github.com/nfnt/resize"
+)
+
+const (
+	aspectSquare   = "square"
+	aspectPreserve = "preserve"
+)
+
+// thumbSettings determine how thumbs are generated. They're set in the
+// config and in albums' bilder.json, fields that aren't set are inherited.
+type thumbSettings struct {
+	Size        int    `json:"size"`
+	Aspect      string `json:"aspect"`
+	Filter      string `json:"filter"`
+	Quality     int    `json:"quality"`
+	Progressive bool   `json:"progressive"`
+
+	// progressiveSet is whether a config sets Progressive, so that albums
+	// can turn it off again. unknown holds the comma separated keys of a
+	// config's thumb settings that aren't supported. Neither is set after
+	// merge.
+	progressiveSet bool
+	unknown        string
+}
+
+var thumbSettingsKeys = map[string]bool{"size": true, "aspect": true, "filter": true, "quality": true, "progressive": true}
+
+// UnmarshalJSON decodes the thumb settings of a config and records the keys
+// that are set and those it doesn't support, so that warnThumbSettings can
+// reject them.
+func (s *thumbSettings) UnmarshalJSON(byts []byte) error {
+	type plain thumbSettings
+	if err := json.Unmarshal(byts, (*plain)(s)); err != nil {
+		return err
+	}
+
+	var fields map[string]json.RawMessage
+	if err := json.Unmarshal(byts, &fields); err != nil {
+		return err
+	}
+	var unknown []string
+	for k := range fields {
+		switch {
+		case strings.EqualFold(k, "progressive"):
+			s.progressiveSet = true
+		case !thumbSettingsKeys[strings.ToLower(k)]:
+			unknown = append(unknown, k)
+		}
+	}
+	sort.Strings(unknown)
+	s.unknown = strings.Join(unknown, ",")
+	return nil
+}
+
+// defaultThumbSettings match the thumbs of earlier versions of bilder, so
+// that they don't need to be generated again.
+var defaultThumbSettings = thumbSettings{
+	Size:    200,
+	Aspect:  aspectSquare,
+	Filter:  "lanczos3",
+	Quality: 75,
+}
+
+var resizeFilters = map[string]resize.InterpolationFunction{
+	"nearest-neighbor":   resize.NearestNeighbor,
+	"bilinear":           resize.Bilinear,
+	"bicubic":            resize.Bicubic,
+	"mitchell-netravali": resize.MitchellNetravali,
+	"lanczos2":           resize.Lanczos2,
+	"lanczos3":           resize.Lanczos3,
+}
+
+// merge returns s with the valid fields that are set in o replaced.
+func (s thumbSettings) merge(o thumbSettings) thumbSettings {
+	if o.Size > 0 {
+		s.Size = o.Size
+	}
+	if o.Aspect == aspectSquare || o.Aspect == aspectPreserve {
+		s.Aspect = o.Aspect
+	}
+	if _, ok := resizeFilters[o.Filter]; ok {
+		s.Filter = o.Filter
+	}
+	if o.Quality >= 1 && o.Quality <= 100 {
+		s.Quality = o.Quality
+	}
+	if o.progressiveSet {
+		s.Progressive = o.Progressive
+	}
+	return s
+}
+
+// warnThumbSettings logs the settings in o that merge ignores, where is the
+// config they're set in.
+func warnThumbSettings(where string, o thumbSettings) {
+	if o.Size < 0 {
+		log.Printf("Ignoring thumb size %v in %v, it needs to be positive.", o.Size, where)
+	}
+	if o.Aspect != "" && o.Aspect != aspectSquare && o.Aspect != aspectPreserve {
+		log.Printf("Ignoring thumb aspect %#v in %v, expected %#v or %#v.", o.Aspect, where, aspectSquare, aspectPreserve)
+	}
+	if _, ok := resizeFilters[o.Filter]; o.Filter != "" && !ok {
+		log.Printf("Ignoring unknown thumb filter %#v in %v.", o.Filter, where)
+	}
+	if o.Quality < 0 || o.Quality > 100 {
+		log.Printf("Ignoring thumb quality %v in %v, it needs to be between 1 and 100.", o.Quality, where)
+	}
+	for _, k := range strings.Split(o.unknown, ",") {
+		if k != "" {
+			log.Printf("Ignoring unknown thumb setting %#v in %v.", k, where)
+		}
+	}
+}
+
+// key identifies the settings that determine how thumbs look. It's empty
+// for the default settings, so that thumbs that were generated before the
+// key was recorded are up to date as long as the defaults are used.
+func (s thumbSettings) key() string {
+	if s == defaultThumbSettings {
+		return ""
+	}
+	k := fmt.Sprintf("%v %v %v %v", s.Size, s.Aspect, s.Filter, s.Quality)
+	if s.Progressive {
+		k += " progressive"
+	}
+	return k
+}
+
+// dimensions returns the dimensions of the thumb of an upright w by h
+// image. Thumbs that preserve the aspect ratio are s.Size high, so that
+// they can be laid out in rows. Images without known dimensions get square
+// thumbs.
+func (s thumbSettings) dimensions(w, h int) (int, int) {
+	if s.Aspect != aspectPreserve || w <= 0 || h <= 0 {
+		return s.Size, s.Size
+	}
+	tw := int(math.Round(float64(w) * float64(s.Size) / float64(h)))
+	if tw < 1 {
+		tw = 1
+	}
+	return tw, s.Size
+}
@@ -1,107 +1,575 @@
 package main
 
 import (
-	"bytes"
 	"encoding/json"
-	"html/template"
-	"image"
-	"image/jpeg"
+	"fmt"
 	"io/ioutil"
 	"log"
 	"os"
+	"path"
 	"path/filepath"
+	"reflect"
 	"regexp"
 	"sort"
 	"strings"
 	"time"
 
-	"github.com/nfnt/resize"
-	"github.com/oliamb/cutter"
+	"github.com/fsnotify/fsnotify"
+)
+
+const (
+	mediaImage = "image"
+	mediaVideo = "video"
 )
 
 type imgDetails struct {
-	Thumb     string
-	Width     int
-	Height    int
-	Caption   string
-	Path      string
-	ThumbPath string
-	ModTime   time.Time
+	Type        string
+	Thumb       string
+	Width       int
+	Height      int
+	Caption     string
+	Path        string
+	ThumbPath   string
+	Thumb2xPath string
+	ThumbWidth  int
+	ThumbHeight int
+	PosterPath  string
+	Cover       string // larger rendition if the image is its album's cover
+	CoverPath   string
+	Renditions  []rendition // for display, smallest first
+	ModTime     time.Time
+	Exif        exifDetails
+	poster      string
 }
 
 type dirDetails struct {
 	URLPathPrefix string
+	PublicURL     string
 	Title         string
+	ShowExif      bool
+	Thumbs        thumbSettings
+	TileSize      int // of sub-albums' tiles
 	Images        []*imgDetails
+	Cover         *imgDetails
+	Albums        []albumTile  // sub-albums
+	Breadcrumbs   []breadcrumb // parent albums
+}
+
+type breadcrumb struct {
+	Title string
+	Path  string
 }
 
 type album struct {
-	name       string
-	user, pass string
+	name          string
+	realm         string // album whose credentials this album uses
+	creds         map[string]string
+	loginForm     *bool
+	revokedTokens []string // IDs of share tokens that no longer grant access
+	listed        *bool
+	details       dirDetails
 }
 
 func (a album) hasAuth() bool {
-	return len(a.user) > 0 && len(a.pass) > 0
+	return len(a.creds) > 0
 }
 
 type watcher struct {
 	dir           string
 	delaySeconds  int
 	urlPathPrefix string
+	publicURL     string
+	overview      bool
 	configs       map[string]dirConfig
 	images        map[string]map[string]*imgDetails
 	albumUpdates  chan<- []album
+	fsw           *fsnotify.Watcher
+	index         *imageIndex
+	thumbs        *thumbnailer
+	layout        layout
+	gc            *collector
+	reserved      map[string]bool // skipped directories with reserved names
 }
 
-func newWatcher(ds int, d, upp string, au chan<- []album) *watcher {
-	return &watcher{delaySeconds: ds, dir: d, urlPathPrefix: upp, albumUpdates: au}
+func newWatcher(c config, au chan<- []album) *watcher {
+	l := layout{dir: c.BilderDir, cacheDir: c.CacheDir}
+	return &watcher{
+		delaySeconds:  c.ReloadDelaySeconds,
+		dir:           c.BilderDir,
+		urlPathPrefix: c.URLPathPrefix,
+		publicURL:     c.PublicURL,
+		overview:      c.Overview,
+		albumUpdates:  au,
+		index:         loadIndex(l.indexPath()),
+		thumbs:        newThumbnailer(l, c.ThumbWorkers, c.FFmpeg, c.DisplaySizes, c.Thumbs),
+		layout:        l,
+		gc:            newCollector(c.GCDryRun),
+	}
 }
 
 type dirConfig struct {
-	Title      string
-	Captions   map[string]string
-	User, Pass string
-	SortOrder  string `json:"sort-order"`
+	Title         string
+	Captions      map[string]string
+	User, Pass    string
+	Users         map[string]string
+	LoginForm     *bool         `json:"login-form"`
+	RevokedTokens []string      `json:"revoked-tokens"`
+	Listed        *bool         `json:"listed"`
+	Cover         string        `json:"cover"`
+	SortOrder     string        `json:"sort-order"`
+	SortDirection string        `json:"sort-direction"`
+	ShowExif      bool          `json:"show-exif"`
+	Thumbs        thumbSettings `json:"thumbs"`
+}
+
+// credentials maps the album's user names to their passwords, which are
+// either hashes or plaintext.
+func (c dirConfig) credentials() map[string]string {
+	cs := map[string]string{}
+	if c.User != "" && c.Pass != "" {
+		cs[c.User] = c.Pass
+	}
+	for u, p := range c.Users {
+		if u != "" && p != "" {
+			cs[u] = p
+		}
+	}
+	return cs
+}
+
+func warnPlaintextPasswords(d string, c dirConfig) {
+	for u, p := range c.credentials() {
+		if !isPasswordHash(p) {
+			log.Printf("Deprecated plaintext password for user %#v of album %#v, use bilder hash-password to create a hash.", u, d)
+		}
+	}
 }
 
 var (
-	thumbRegexp     = regexp.MustCompile("(?i)^(.+)_thumb\\.(jpg|jpeg)$")
-	imageRegexp     = regexp.MustCompile("(?i)^(.+)\\.(jpg|jpeg)$")
+	imageRegexp     = regexp.MustCompile("(?i)^(.+)\\.(jpg|jpeg|png|gif|webp)$")
+	videoRegexp     = regexp.MustCompile("(?i)^(.+)\\.(mp4|webm)$")
+	posterRegexp    = regexp.MustCompile("(?i)^(.+)_poster\\.(jpg|jpeg)$")
 	dirConfigRegexp = regexp.MustCompile("(?i)^bilder.json$")
 )
 
+// eventDelay is how long to collect file system events before reloading
+// the affected albums, so that copying many files triggers a single reload.
+const eventDelay = 500 * time.Millisecond
+
 func (w *watcher) start() {
+	w.thumbs.start()
+	w.collectStalePages()
+	w.reloadContents()
+	w.passAlbumUpdates()
+
+	var events <-chan fsnotify.Event
+	var errs <-chan error
+	fsw, err := fsnotify.NewWatcher()
+	if err != nil {
+		log.Printf("Failed to create file system watcher, falling back to periodic scans only, err=%v", err)
+	} else {
+		defer fsw.Close()
+		w.fsw = fsw
+		w.watchDirs()
+		events, errs = fsw.Events, fsw.Errors
+	}
+
+	rescan := time.NewTicker(time.Duration(w.delaySeconds) * time.Second)
+	defer rescan.Stop()
+
+	dirty := map[string]struct{}{}
+	var flush <-chan time.Time
 	for {
-		w.reloadContents()
-		w.ensureThumbs()
-		w.writeIndexes()
-		w.passAlbumUpdates()
-		w.reset()
-		<-time.After(time.Duration(w.delaySeconds) * time.Second)
+		select {
+		case ev := <-events:
+			as := w.albumsForEvent(ev)
+			if len(as) == 0 {
+				continue
+			}
+			for _, a := range as {
+				dirty[a] = nada
+			}
+			if flush == nil {
+				flush = time.After(eventDelay)
+			}
+		case err := <-errs:
+			log.Printf("File system watcher failed, err=%v", err)
+		case r := <-w.thumbs.results:
+			if !w.thumbGenerated(r) {
+				continue
+			}
+			if flush == nil {
+				flush = time.After(eventDelay)
+			}
+		case <-flush:
+			flush = nil
+			var cs indexChanges
+			for a := range dirty {
+				cs.merge(w.refreshAlbum(a))
+			}
+			dirty = map[string]struct{}{}
+			logChanges(cs)
+			w.index.save()
+			w.passAlbumUpdates()
+		case <-rescan.C:
+			w.reloadContents()
+			w.watchDirs()
+			w.passAlbumUpdates()
+		}
+	}
+}
+
+func (w *watcher) watchDirs() {
+	if w.fsw == nil {
+		return
+	}
+
+	if err := w.fsw.Add(w.dir); err != nil {
+		log.Printf("Failed to watch %#v, err=%v", w.dir, err)
+	}
+
+	for _, d := range w.albumDirs("") {
+		w.watchAlbum(d)
+	}
+}
+
+// albumDirs returns album d, or the bilder directory if empty, and all
+// directories below it that may contain albums.
+func (w *watcher) albumDirs(d string) []string {
+	var ds []string
+	root := w.layout.albumDir(d)
+	err := filepath.Walk(root, func(p string, fi os.FileInfo, err error) error {
+		if err != nil {
+			log.Printf("Failed to read %#v, err=%v", p, err)
+			return nil
+		}
+		if p == root {
+			if d != "" {
+				ds = append(ds, d)
+			}
+			return nil
+		}
+		if !w.isAlbumDir(p, fi) {
+			if fi.IsDir() {
+				return filepath.SkipDir
+			}
+			return nil
+		}
+		rel, err := filepath.Rel(w.dir, p)
+		if err != nil {
+			return filepath.SkipDir
+		}
+		ds = append(ds, filepath.ToSlash(rel))
+		return nil
+	})
+	if err != nil {
+		log.Printf("Failed to read contents of %#v, err=%v", root, err)
+	}
+	return ds
+}
+
+// reservedAlbumNames are the paths below an album's URL that bilder serves
+// itself, sub-albums with these names would hide them.
+var reservedAlbumNames = map[string]bool{thumbsPath: true, resizePath: true, loginPath: true, logoutPath: true}
+
+// isAlbumDir reports whether fi, found at p, is a directory that may
+// contain an album, skipping hidden directories, the cache directory and
+// directories that would clash with bilder's URLs.
+func (w *watcher) isAlbumDir(p string, fi os.FileInfo) bool {
+	if !fi.IsDir() || strings.HasPrefix(fi.Name(), ".") || w.layout.isCacheDir(p) {
+		return false
+	}
+	if reservedAlbumNames[fi.Name()] {
+		if !w.reserved[p] {
+			log.Printf("Skipping directory %#v, its name is reserved for bilder's URLs.", p)
+			if w.reserved == nil {
+				w.reserved = map[string]bool{}
+			}
+			w.reserved[p] = true
+		}
+		return false
+	}
+	return true
+}
+
+func (w *watcher) watchAlbum(d string) {
+	if w.fsw == nil {
+		return
+	}
+
+	p := w.layout.albumDir(d)
+	if err := w.fsw.Add(p); err != nil {
+		log.Printf("Failed to watch %#v, err=%v", p, err)
+	}
+}
+
+// knownAlbums returns the albums with images or a config.
+func (w *watcher) knownAlbums() map[string]struct{} {
+	as := map[string]struct{}{}
+	for a := range w.images {
+		as[a] = nada
+	}
+	for a := range w.configs {
+		as[a] = nada
+	}
+	return as
+}
+
+// albumsForEvent returns the albums affected by the given event, ignoring
+// events for files that bilder writes itself like thumbs and indexes.
+func (w *watcher) albumsForEvent(ev fsnotify.Event) []string {
+	if ev.Op == fsnotify.Chmod {
+		return nil
 	}
+
+	rel, err := filepath.Rel(w.dir, ev.Name)
+	if err != nil || rel == "." || strings.HasPrefix(rel, "..") {
+		return nil
+	}
+	rel = filepath.ToSlash(rel)
+
+	d, n := path.Split(rel)
+	d = strings.TrimSuffix(d, "/")
+	if strings.HasPrefix(n, ".") {
+		return nil
+	}
+
+	// new directories are watched along with the ones created inside
+	// before the watch was in place, e.g. when a tree is copied.
+	if ev.Op&fsnotify.Create == fsnotify.Create {
+		if fi, err := os.Stat(ev.Name); err == nil && fi.IsDir() {
+			if !w.isAlbumDir(ev.Name, fi) {
+				return nil
+			}
+			ds := w.albumDirs(rel)
+			for _, a := range ds {
+				w.watchAlbum(a)
+			}
+			return ds
+		}
+	}
+
+	// removed or renamed albums, including their sub-albums
+	var as []string
+	for a := range w.knownAlbums() {
+		if a == rel || strings.HasPrefix(a, rel+"/") {
+			as = append(as, a)
+		}
+	}
+	if len(as) > 0 || d == "" {
+		return as
+	}
+
+	switch {
+	case w.isRendition(d, n):
+		return nil
+	case imageRegexp.MatchString(n), videoRegexp.MatchString(n), dirConfigRegexp.MatchString(n):
+		return []string{d}
+	}
+
+	return nil
 }
 
-func (w *watcher) reset() {
-	w.images = nil
-	w.configs = nil
+// isRendition reports whether n is the name of a rendition that bilder
+// generated for an image of album d.
+func (w *watcher) isRendition(d, n string) bool {
+	for i := range w.images[d] {
+		if _, ok := w.renditionFiles(i)[n]; ok {
+			return true
+		}
+	}
+	return false
+}
+
+// refreshAlbum reloads album d and ensures its thumbs if anything changed
+// since the last scan.
+func (w *watcher) refreshAlbum(d string) indexChanges {
+	cs, changed := w.reloadAlbum(d)
+	if _, ok := w.images[d]; !ok || !changed {
+		return cs
+	}
+
+	w.ensureThumbs(d)
+	return cs
+}
+
+func logChanges(cs indexChanges) {
+	if cs.empty() {
+		return
+	}
+	log.Printf(
+		"Found %v added, %v modified and %v removed images.",
+		len(cs.Added), len(cs.Modified), len(cs.Removed),
+	)
+}
+
+// parentAlbum returns the album that contains album d, or "" for
+// top-level albums.
+func parentAlbum(d string) string {
+	if i := strings.LastIndex(d, "/"); i >= 0 {
+		return d[:i]
+	}
+	return ""
+}
+
+// authConfig returns the config of the album that album d inherits its
+// credentials from, which is the closest album including d itself whose
+// bilder.json sets credentials, and that album's name.
+func (w *watcher) authConfig(d string) (dirConfig, string) {
+	for a := d; a != ""; a = parentAlbum(a) {
+		if c, ok := w.configs[a]; ok && len(c.credentials()) > 0 {
+			return c, a
+		}
+	}
+	return dirConfig{}, ""
+}
+
+func (w *watcher) albumTitle(d string) string {
+	if cfg, exists := w.configs[d]; exists && cfg.Title != "" {
+		return cfg.Title
+	}
+	return path.Base(d)
+}
+
+func (w *watcher) album(d string) album {
+	ac, realm := w.authConfig(d)
+	a := album{
+		name:    d,
+		realm:   realm,
+		creds:   ac.credentials(),
+		listed:  w.configs[d].Listed,
+		details: w.albumDetails(d),
+	}
+
+	a.loginForm = ac.LoginForm
+	if lf := w.configs[d].LoginForm; lf != nil {
+		a.loginForm = lf
+	}
+
+	for p := d; p != ""; p = parentAlbum(p) {
+		a.revokedTokens = append(a.revokedTokens, w.configs[p].RevokedTokens...)
+	}
+
+	if w.overview {
+		a.details.Breadcrumbs = []breadcrumb{{Title: "Albums", Path: w.urlPathPrefix + "/b/"}}
+	}
+	var ps []breadcrumb
+	for p := parentAlbum(d); p != ""; p = parentAlbum(p) {
+		ps = append([]breadcrumb{{Title: w.albumTitle(p), Path: w.urlPathPrefix + "/b/" + p + "/"}}, ps...)
+	}
+	a.details.Breadcrumbs = append(a.details.Breadcrumbs, ps...)
+
+	return a
 }
 
 func (w *watcher) passAlbumUpdates() {
-	var as []album
+	// albums with images and their parents, which show their sub-albums
+	names := map[string]struct{}{}
 	for a, is := range w.images {
-		if len(is) > 0 {
-			var u, p string
-			dc, ok := w.configs[a]
-			if ok {
-				u = dc.User
-				p = dc.Pass
+		if len(is) == 0 {
+			continue
+		}
+		for ; a != ""; a = parentAlbum(a) {
+			names[a] = nada
+		}
+	}
+
+	// sub-albums first so their tiles are available to their parents
+	var sorted []string
+	children := map[string][]string{}
+	for a := range names {
+		sorted = append(sorted, a)
+		if p := parentAlbum(a); p != "" {
+			children[p] = append(children[p], a)
+		}
+	}
+	sort.Slice(sorted, func(i, j int) bool {
+		di, dj := strings.Count(sorted[i], "/"), strings.Count(sorted[j], "/")
+		if di != dj {
+			return di > dj
+		}
+		return sorted[i] < sorted[j]
+	})
+
+	albums := map[string]album{}
+	var as []album
+	for _, n := range sorted {
+		a := w.album(n)
+		cs := children[n]
+		sort.Strings(cs)
+		for _, c := range cs {
+			if t, listed := newAlbumTile(w.urlPathPrefix, albums[c], a.realm); listed {
+				a.details.Albums = append(a.details.Albums, t)
 			}
-			as = append(as, album{name: a, user: u, pass: p})
 		}
+		albums[n] = a
+		as = append(as, a)
 	}
+
 	w.albumUpdates <- as
 }
 
+// validRendition reports whether the generated file f of album d at p is a
+// complete image that is newer than its original, which was modified at mt.
+// Files are only checked again when they change, also across restarts.
+// Originals with modification times in the future, e.g. due to a wrong
+// clock, are assumed to be older.
+func (w *watcher) validRendition(d, p string, f os.FileInfo, mt time.Time) bool {
+	if f.ModTime().Before(mt) && mt.Before(time.Now()) {
+		log.Printf("Regenerating outdated %#v.", p)
+		return false
+	}
+
+	if w.index.isChecked(d, f) {
+		return true
+	}
+	if err := checkJPEG(p); err != nil {
+		log.Printf("Regenerating invalid %#v, err=%v", p, err)
+		return false
+	}
+	w.index.check(d, f)
+	return true
+}
+
+// renditionFile is a rendition of an image or video that bilder generates.
+type renditionFile struct {
+	image string
+	kind  string
+	size  int // long edge of display renditions
+}
+
+// renditionFiles returns the renditions that bilder generates for image or
+// video n by their names.
+func (w *watcher) renditionFiles(n string) map[string]renditionFile {
+	rs := map[string]renditionFile{
+		thumbName(n):   {image: n, kind: "thumb"},
+		thumb2xName(n): {image: n, kind: "thumb2x"},
+		coverName(n):   {image: n, kind: "cover"},
+	}
+	for _, s := range w.thumbs.sizes {
+		rs[displayName(n, s)] = renditionFile{image: n, kind: "display", size: s}
+	}
+	return rs
+}
+
+// renditionDir returns the directory of album d that renditions of the
+// given kind are stored in. Only thumbs may be stored next to the images,
+// other renditions are kept out of the album directories so that they can't
+// replace photos with the same name.
+func (w *watcher) renditionDir(d, kind string) string {
+	if kind == "thumb" {
+		return w.layout.thumbDir(d)
+	}
+	return w.layout.renditionDir(d)
+}
+
+func (w *watcher) renditionURL(d, kind, n string) string {
+	if kind == "thumb" {
+		return w.layout.thumbURL(d, n)
+	}
+	return w.layout.renditionURL(d, n)
+}
+
 type byImgName []*imgDetails
 
 func (a byImgName) Len() int           { return len(a) }
@@ -112,117 +580,192 @@ type byImgModTime []*imgDetails
 
 func (a byImgModTime) Len() int           { return len(a) }
 func (a byImgModTime) Swap(i, j int)      { a[i], a[j] = a[j], a[i] }
-func (a byImgModTime) Less(i, j int) bool { return a[i].ModTime.Unix() > a[j].ModTime.Unix() }
+func (a byImgModTime) Less(i, j int) bool { return a[i].ModTime.Unix() < a[j].ModTime.Unix() }
 
-func (w *watcher) writeIndexes() {
-	tmpl := template.Must(template.New("dirIndex").Parse(dirIndexTempl))
-	for d, is := range w.images {
-		p := filepath.Join(w.dir, d, "index.html")
-		var ids []*imgDetails
-		for _, id := range is {
-			ids = append(ids, id)
-		}
-		title := d
-		if cfg, exists := w.configs[d]; exists && cfg.Title != "" {
-			title = cfg.Title
-		}
+type byImgTaken []*imgDetails
 
-		if cfg, exists := w.configs[d]; exists && cfg.SortOrder == "ModTime" {
-			sort.Sort(byImgModTime(ids))
-		} else {
-			sort.Sort(byImgName(ids))
-		}
+func (a byImgTaken) Len() int           { return len(a) }
+func (a byImgTaken) Swap(i, j int)      { a[i], a[j] = a[j], a[i] }
+func (a byImgTaken) Less(i, j int) bool { return a[i].taken().Before(a[j].taken()) }
 
-		dd := dirDetails{
-			URLPathPrefix: w.urlPathPrefix,
-			Title:         title,
-			Images:        ids,
-		}
-		var buf bytes.Buffer
-		if err := tmpl.Execute(&buf, dd); err != nil {
-			log.Printf("Failed to execute index template for %#v, err=%v\n", d, err)
-			return
-		}
+// taken returns when the image was captured according to its EXIF data,
+// falling back to its modification time.
+func (id *imgDetails) taken() time.Time {
+	if !id.Exif.Taken.IsZero() {
+		return id.Exif.Taken
+	}
+	return id.ModTime
+}
 
-		if err := ioutil.WriteFile(p, buf.Bytes(), 0644); err != nil {
-			log.Printf("Failed to write index.html for %#v, err=%v\n", d, err)
-			return
-		}
+// sortImages sorts ids according to the sort order and direction of cfg.
+// Images that are equal in the sort order are sorted by name.
+func sortImages(ids []*imgDetails, cfg dirConfig) {
+	sort.Sort(byImgName(ids))
+
+	var s sort.Interface
+	var desc bool
+	switch cfg.SortOrder {
+	case "ModTime":
+		s, desc = byImgModTime(ids), true
+	case "Taken":
+		s = byImgTaken(ids)
+	default:
+		s = byImgName(ids)
 	}
+
+	switch strings.ToLower(cfg.SortDirection) {
+	case "asc":
+		desc = false
+	case "desc":
+		desc = true
+	}
+
+	if desc {
+		s = sort.Reverse(s)
+	}
+	sort.Stable(s)
 }
 
-func (w *watcher) ensureThumbs() {
-	for d, is := range w.images {
-		for i, id := range is {
-			if id.Thumb == "" {
-				tn, err := w.generateThumb(d, i)
-				if err != nil {
-					log.Printf("Failed to generate thumb for %#v in %#v, err=%v", i, d, err)
-					continue
-				}
-				id.ThumbPath = strings.Join([]string{"b", d, tn}, "/")
+// albumDetails returns a snapshot of album d for rendering its page.
+func (w *watcher) albumDetails(d string) dirDetails {
+	var ids []*imgDetails
+	for _, id := range w.images[d] {
+		cp := *id
+		ids = append(ids, &cp)
+	}
+	sortImages(ids, w.configs[d])
+
+	return dirDetails{
+		URLPathPrefix: w.urlPathPrefix,
+		PublicURL:     w.publicURL,
+		Title:         w.albumTitle(d),
+		ShowExif:      w.configs[d].ShowExif,
+		Thumbs:        w.thumbSettings(d),
+		TileSize:      w.thumbs.settings.Size,
+		Images:        ids,
+		Cover:         albumCover(ids, w.configs[d]),
+	}
+}
+
+// thumbSettings returns the settings for the thumbs of album d, set in its
+// config or inherited from its parent albums and the config.
+func (w *watcher) thumbSettings(d string) thumbSettings {
+	s := w.thumbs.settings
+	if p := parentAlbum(d); p != "" {
+		s = w.thumbSettings(p)
+	}
+	return s.merge(w.configs[d].Thumbs)
+}
+
+// albumCover returns the image that is set as cover in cfg, falling back to
+// the first image of ids in the album's order.
+func albumCover(ids []*imgDetails, cfg dirConfig) *imgDetails {
+	if len(ids) == 0 {
+		return nil
+	}
+	if cfg.Cover != "" {
+		for _, id := range ids {
+			if path.Base(id.Path) == cfg.Cover {
+				return id
 			}
 		}
 	}
+	return ids[0]
 }
 
-func (w *watcher) generateThumb(d, n string) (string, error) {
-	p := filepath.Join(w.dir, d, n)
-	ih, err := os.Open(p)
-	if err != nil {
-		return "", err
+func (w *watcher) ensureThumbs(d string) {
+	for i, id := range w.images[d] {
+		if id.Thumb != "" && id.Thumb2xPath != "" && len(id.Renditions) == len(w.thumbs.displaySizes(i, id.Width, id.Height)) {
+			continue
+		}
+		if id.Type == mediaVideo && id.poster == "" && w.thumbs.ffmpeg == "" {
+			continue // no poster to generate thumb from
+		}
+		w.thumbs.enqueue(d, i, id.poster, false, w.thumbSettings(d))
 	}
-	defer ih.Close()
+	w.ensureCover(d)
+}
 
-	matches := imageRegexp.FindAllStringSubmatch(n, -1)
-	base, ending := matches[0][1], matches[0][2]
-	tn := base + "_thumb." + ending
-	tp := filepath.Join(w.dir, d, tn)
-	th, err := os.Create(tp)
-	if err != nil {
-		return "", err
+// ensureCover generates the cover rendition of album d's cover image, which
+// is named after the image so that it needs to be generated again when a
+// different image becomes the cover.
+func (w *watcher) ensureCover(d string) {
+	c := albumCover(w.albumDetails(d).Images, w.configs[d])
+	if c == nil || c.Cover != "" {
+		return
 	}
-	defer func() {
-		th.Sync()
-		th.Close()
-		log.Printf("Generated thumb %v\n", tp)
-	}()
+	if c.Type == mediaVideo && c.poster == "" {
+		return // generated once the poster is extracted
+	}
+	w.thumbs.enqueue(d, path.Base(c.Path), c.poster, true, thumbSettings{})
+}
 
-	img, err := jpeg.Decode(ih)
-	if err != nil {
-		return "", err
+// thumbGenerated records the thumb of a finished job, if its image is still
+// part of the album, and reports whether the album changed.
+func (w *watcher) thumbGenerated(r thumbResult) bool {
+	if r.err != nil {
+		log.Printf("Failed to generate thumb for %#v in %#v, err=%v", r.name, r.album, r.err)
+		return false
 	}
 
-	if _, err := ih.Seek(0, 0); err != nil {
-		log.Printf("Failed to reset reader for %#v, err=%v", p, err)
+	// files in album directories are recorded, so that the garbage
+	// collection only ever removes files that bilder wrote
+	if w.layout.inPlace() && r.thumb != "" {
+		w.recordGenerated(r.album, r.thumb)
+		if r.extracted {
+			w.recordGenerated(r.album, filepath.Base(r.poster))
+		}
 	}
 
-	imgConf, _, err := image.DecodeConfig(ih)
-	if err != nil {
-		log.Printf("Failed to decode config from %#v, err=%v", p, err)
+	id, ok := w.images[r.album][r.name]
+	if !ok {
+		return false
+	}
+	if r.cover != "" {
+		id.Cover = r.cover
+		id.CoverPath = w.layout.renditionURL(r.album, r.cover)
+		return true
 	}
 
-	var isPortrait bool
-	if imgConf.Width < imgConf.Height {
-		isPortrait = true
+	id.Thumb = r.thumb
+	id.ThumbPath = w.layout.thumbURL(r.album, r.thumb)
+	if e, ok := w.index.entries[indexKey(r.album, r.name)]; ok && e.Thumbs != r.settings.key() {
+		e.Thumbs = r.settings.key()
+		w.index.put(r.album, r.name, e)
+	}
+	id.Thumb2xPath = w.layout.renditionURL(r.album, r.thumb2x)
+	id.Renditions = nil
+	for _, dr := range r.display {
+		id.Renditions = append(id.Renditions, rendition{Width: dr.Width, Height: dr.Height, Path: w.layout.renditionURL(r.album, dr.Path)})
 	}
 
-	var resized image.Image
-	if isPortrait {
-		resized = resize.Resize(200, 0, img, resize.Lanczos3)
-	} else {
-		resized = resize.Resize(0, 200, img, resize.Lanczos3)
+	// extracted posters may not be watched, so record them right away
+	if id.Type == mediaVideo && id.poster != r.poster {
+		pe, err := readImageDetails(r.poster)
+		if err != nil {
+			log.Printf("Failed to decode poster %#v for details, err=%v", r.poster, err)
+			return true
+		}
+		id.poster = r.poster
+		id.PosterPath = w.layout.thumbURL(r.album, filepath.Base(r.poster))
+		id.Width, id.Height = pe.Width, pe.Height
+		if e, ok := w.index.entries[indexKey(r.album, r.name)]; ok {
+			e.Poster, e.Width, e.Height = r.poster, pe.Width, pe.Height
+			w.index.put(r.album, r.name, e)
+		}
+		w.ensureCover(r.album)
 	}
+	return true
+}
 
-	square, err := cutter.Crop(
-		resized,
-		cutter.Config{Width: 200, Height: 200, Mode: cutter.Centered},
-	)
+func (w *watcher) recordGenerated(d, n string) {
+	p := filepath.Join(w.layout.albumDir(d), n)
+	fi, err := os.Stat(p)
 	if err != nil {
-		log.Printf("Failed to crop thumb for %#v, err=%v", p, err)
+		log.Printf("Failed to stat generated file %#v, err=%v", p, err)
+		return
 	}
-
-	return tn, jpeg.Encode(th, square, nil)
+	w.index.record(d, fi)
 }
 
 type byName []os.FileInfo
@@ -233,368 +776,302 @@ func (a byName) Less(i, j int) bool { return a[i].Name() < a[j].Name() }
 
 func (w *watcher) reloadContents() {
 	log.Printf("Reloading contents of %#v.", w.dir)
-	ds, err := ioutil.ReadDir(w.dir)
+
+	var cs indexChanges
+	found := map[string]struct{}{}
+	for _, d := range w.albumDirs("") {
+		found[d] = nada
+		cs.merge(w.refreshAlbum(d))
+	}
+
+	for d := range w.knownAlbums() {
+		if _, ok := found[d]; !ok {
+			cs.merge(w.refreshAlbum(d))
+		}
+	}
+	w.collectRemovedAlbums(found)
+
+	logChanges(cs)
+	w.index.save()
+}
+
+// reloadAlbum replaces the images and config of album d with the current
+// contents of its directory, forgetting the album if it no longer exists.
+// Images whose size and modification time match the index aren't decoded
+// again. It returns the changed images and whether the album's config or
+// images changed.
+func (w *watcher) reloadAlbum(d string) (indexChanges, bool) {
+	var cs indexChanges
+	p := w.layout.albumDir(d)
+	fs, err := ioutil.ReadDir(p)
 	if err != nil {
-		log.Printf("Failed to read contents of %#v, err=%v", w.dir, err)
-		return
+		if !os.IsNotExist(err) {
+			log.Printf("Failed to read contents of %#v, err=%v", p, err)
+		} else {
+			w.collectRemovedAlbum(d)
+		}
+		if _, ok := w.images[d]; ok {
+			log.Printf("Removing album %#v.", d)
+		}
+		delete(w.images, d)
+		delete(w.configs, d)
+		cs.Removed = w.index.prune(d, nil)
+		w.index.pruneGenerated(d, nil)
+		w.index.pruneChecked(d, nil)
+		return cs, true
+	}
+	sort.Sort(byName(fs))
+
+	if w.images == nil {
+		w.images = map[string]map[string]*imgDetails{}
+	}
+	if w.configs == nil {
+		w.configs = map[string]dirConfig{}
 	}
+	oldCfg, hadCfg := w.configs[d]
+	delete(w.configs, d)
+	is := map[string]*imgDetails{}
+	stale := map[string]bool{}
 
-	for _, d := range ds {
-		if d.IsDir() {
-			p := filepath.Join(w.dir, d.Name())
-			fs, err := ioutil.ReadDir(p)
+	// find config first, to load captions
+	for _, f := range fs {
+		switch {
+		case f.IsDir() || f.Size() == 0:
+			continue
+		case dirConfigRegexp.MatchString(f.Name()):
+			fp := filepath.Join(p, f.Name())
+			byts, err := ioutil.ReadFile(fp)
 			if err != nil {
-				log.Printf("Failed to read contents of %#v, err=%v", p, err)
+				log.Printf("Failed to read dir config %#v, err=%v", fp, err)
 				continue
 			}
-			sort.Sort(byName(fs)) // sort so thumbs always appear after img
-
-			// find config first, to load captions
-			for _, f := range fs {
-				switch {
-				case f.IsDir() || f.Size() == 0:
-					continue
-				case dirConfigRegexp.MatchString(f.Name()):
-					fp := filepath.Join(p, f.Name())
-					byts, err := ioutil.ReadFile(fp)
-					if err != nil {
-						log.Printf("Failed to read dir config %#v, err=%v", fp, err)
-						continue
-					}
-					var cfg dirConfig
-					if err = json.Unmarshal(byts, &cfg); err != nil {
-						log.Printf("Failed to unmarshal dir config %#v, err=%v", fp, err)
-						continue
-					}
-					if w.configs == nil {
-						w.configs = map[string]dirConfig{d.Name(): cfg}
-					} else {
-						w.configs[d.Name()] = cfg
-					}
-				}
+			var cfg dirConfig
+			if err = json.Unmarshal(byts, &cfg); err != nil {
+				log.Printf("Failed to unmarshal dir config %#v, err=%v", fp, err)
+				continue
 			}
+			if !reflect.DeepEqual(oldCfg, cfg) {
+				warnPlaintextPasswords(d, cfg)
+				warnThumbSettings(fmt.Sprintf("%#v", fp), cfg.Thumbs)
+			}
+			w.configs[d] = cfg
+		}
+	}
 
-			// find images and possibly thumbs
-			for _, f := range fs {
-				switch {
-				case f.IsDir() || f.Size() == 0:
-					continue
-				case thumbRegexp.MatchString(f.Name()):
-					if w.images == nil {
-						log.Printf("Unexpected thumb image %#v in %#v", f.Name(), d.Name())
-						continue
-					}
+	// generated files are in the album directory or the cache directory
+	gfs := fs
+	if !w.layout.inPlace() {
+		td := w.layout.thumbDir(d)
+		if gfs, err = ioutil.ReadDir(td); err != nil && !os.IsNotExist(err) {
+			log.Printf("Failed to read contents of %#v, err=%v", td, err)
+		}
+	}
 
-					_, dirExists := w.images[d.Name()]
-					if !dirExists {
-						log.Printf("Unexpected thumb image %#v in %#v", f.Name(), d.Name())
-						continue
-					}
+	// renditions other than thumbs may be stored in their own directory
+	rfs := gfs
+	if rd := w.layout.renditionDir(d); rd != w.layout.thumbDir(d) {
+		if rfs, err = ioutil.ReadDir(rd); err != nil && !os.IsNotExist(err) {
+			log.Printf("Failed to read contents of %#v, err=%v", rd, err)
+		}
+	}
 
-					matches := thumbRegexp.FindAllStringSubmatch(f.Name(), -1)
-					base, ending := matches[0][1], matches[0][2]
-					img := base + "." + ending
-					_, imgExists := w.images[d.Name()][img]
-					if !imgExists {
-						log.Printf("Unexpected thumb image %#v in %#v", f.Name(), d.Name())
-						continue
-					}
+	// find posters of videos, either sidecar files or extracted via ffmpeg,
+	// by path and URL
+	videos := map[string]bool{}
+	posters := map[string]string{}
+	posterURLs := map[string]string{}
+	for _, f := range fs {
+		if m := videoRegexp.FindStringSubmatch(f.Name()); m != nil && !f.IsDir() {
+			videos[m[1]] = true
+		}
+	}
+	for _, f := range gfs {
+		if m := posterRegexp.FindStringSubmatch(f.Name()); m != nil && videos[m[1]] && f.Size() > 0 {
+			posters[m[1]] = filepath.Join(w.layout.thumbDir(d), f.Name())
+			posterURLs[m[1]] = w.layout.thumbURL(d, f.Name())
+		}
+	}
+	for _, f := range fs {
+		if m := posterRegexp.FindStringSubmatch(f.Name()); m != nil && videos[m[1]] && f.Size() > 0 {
+			posters[m[1]] = filepath.Join(p, f.Name())
+			posterURLs[m[1]] = strings.Join([]string{"b", d, f.Name()}, "/")
+		}
+	}
 
-					w.images[d.Name()][img].Thumb = f.Name()
-					w.images[d.Name()][img].ThumbPath = strings.Join([]string{"b", d.Name(), f.Name()}, "/")
+	// renditions are named after images and videos, so that photos with
+	// similar names, e.g. cat_thumb.jpg without cat.jpg, aren't skipped.
+	renditions := map[string]renditionFile{}
+	for _, f := range fs {
+		n := f.Name()
+		if f.IsDir() || !(imageRegexp.MatchString(n) || videoRegexp.MatchString(n)) {
+			continue
+		}
+		for rn, r := range w.renditionFiles(n) {
+			renditions[rn] = r
+		}
+	}
 
-				case imageRegexp.MatchString(f.Name()):
-					p := filepath.Join(w.dir, d.Name(), f.Name())
-					fh, err := os.Open(p)
-					if err != nil {
-						log.Printf("Failed to read %#v for details, err=%v", p, err)
-						continue
+	// find images and videos
+	for _, f := range fs {
+		r := renditions[f.Name()]
+		switch {
+		case f.IsDir() || f.Size() == 0 || strings.HasPrefix(f.Name(), "."):
+			continue
+		case r.image != "" && (r.kind == "thumb" || r.kind == "thumb2x"):
+			// thumbs of the in-place layout, including those written before
+			// bilder recorded generated files, are adopted so that they're
+			// collected once their image is removed. With a cache directory
+			// they're left over from the in-place layout.
+			if w.layout.inPlace() && !w.index.isGenerated(d, f) {
+				w.index.record(d, f)
+			}
+			continue
+		case w.index.isGenerated(d, f):
+			continue
+		case posterRegexp.MatchString(f.Name()) && videos[posterRegexp.FindStringSubmatch(f.Name())[1]]:
+			continue
+		case videoRegexp.MatchString(f.Name()):
+			base := videoRegexp.FindStringSubmatch(f.Name())[1]
+			poster := posters[base]
+			e, ok := w.index.lookup(d, f.Name(), f.Size(), f.ModTime())
+			if !ok || e.Poster != poster {
+				var pe indexEntry
+				if poster != "" {
+					if pe, err = readImageDetails(poster); err != nil {
+						log.Printf("Failed to decode poster %#v for details, err=%v", poster, err)
+						poster = ""
 					}
+				}
 
-					img, _, err := image.DecodeConfig(fh)
-					if err != nil {
-						log.Printf("Failed to decode %#v for details, err=%v", p, err)
-					}
+				k := indexKey(d, f.Name())
+				_, known := w.index.entries[k]
+				if known {
+					cs.Modified = append(cs.Modified, k)
+				} else {
+					cs.Added = append(cs.Added, k)
+				}
+				stale[f.Name()] = known
+				e = indexEntry{Size: f.Size(), ModTime: f.ModTime(), Width: pe.Width, Height: pe.Height, Poster: poster}
+				w.index.put(d, f.Name(), e)
+			}
 
-					var cptn string
-					cfg, cfgExists := w.configs[d.Name()]
-					if cfgExists {
-						cptn = cfg.Captions[f.Name()]
-					}
-					details := &imgDetails{
-						Width:   img.Width,
-						Height:  img.Height,
-						Caption: cptn,
-						Path:    strings.Join([]string{"b", d.Name(), f.Name()}, "/"),
-						ModTime: f.ModTime(),
-					}
+			id := &imgDetails{
+				Type:    mediaVideo,
+				Width:   e.Width,
+				Height:  e.Height,
+				Caption: w.configs[d].Captions[f.Name()],
+				Path:    strings.Join([]string{"b", d, f.Name()}, "/"),
+				ModTime: f.ModTime(),
+				poster:  e.Poster,
+			}
+			if e.Poster != "" {
+				id.PosterPath = posterURLs[base]
+			}
+			is[f.Name()] = id
+		case imageRegexp.MatchString(f.Name()):
+			e, ok := w.index.lookup(d, f.Name(), f.Size(), f.ModTime())
+			if !ok {
+				fp := filepath.Join(p, f.Name())
+				e, err = readImageDetails(fp)
+				if os.IsNotExist(err) {
+					continue
+				}
+				if err != nil {
+					log.Printf("Failed to decode %#v for details, err=%v", fp, err)
+				}
 
-					if w.images == nil {
-						w.images = map[string]map[string]*imgDetails{d.Name(): {f.Name(): details}}
-						continue
-					}
+				k := indexKey(d, f.Name())
+				_, known := w.index.entries[k]
+				if known {
+					cs.Modified = append(cs.Modified, k)
+				} else {
+					cs.Added = append(cs.Added, k)
+				}
+				// thumbs of rotated images may predate orientation support
+				stale[f.Name()] = known || e.Orientation > 1
+				e.Size, e.ModTime = f.Size(), f.ModTime()
+				w.index.put(d, f.Name(), e)
+			}
 
-					if _, dirExists := w.images[d.Name()]; dirExists {
-						w.images[d.Name()][f.Name()] = details
-						continue
-					}
+			is[f.Name()] = &imgDetails{
+				Type:    mediaImage,
+				Width:   e.Width,
+				Height:  e.Height,
+				Caption: w.configs[d].Captions[f.Name()],
+				Path:    strings.Join([]string{"b", d, f.Name()}, "/"),
+				ModTime: f.ModTime(),
+				Exif:    e.Exif,
+			}
+		}
+	}
+
+	ts := w.thumbSettings(d)
+	for _, id := range is {
+		id.ThumbWidth, id.ThumbHeight = ts.dimensions(id.Width, id.Height)
+	}
+
+	// find renditions, invalid ones and thumbs that were generated with
+	// other settings are regenerated
+	var invalid, outdated bool
+	dirs := map[string][]os.FileInfo{w.layout.thumbDir(d): gfs, w.layout.renditionDir(d): rfs}
+	for dir, dfs := range dirs {
+		for _, f := range dfs {
+			r, ok := renditions[f.Name()]
+			if f.IsDir() || !ok || w.renditionDir(d, r.kind) != dir || is[r.image] == nil || stale[r.image] {
+				continue
+			}
+			if (r.kind == "thumb" || r.kind == "thumb2x") && w.index.entries[indexKey(d, r.image)].Thumbs != ts.key() {
+				outdated = true
+				continue
+			}
+			if !w.validRendition(d, filepath.Join(dir, f.Name()), f, is[r.image].ModTime) {
+				invalid = true
+				continue
+			}
 
-					w.images[d.Name()] = map[string]*imgDetails{f.Name(): details}
+			id, u := is[r.image], w.renditionURL(d, r.kind, f.Name())
+			switch r.kind {
+			case "thumb":
+				id.Thumb, id.ThumbPath = f.Name(), u
+			case "thumb2x":
+				id.Thumb2xPath = u
+			case "cover":
+				id.Cover, id.CoverPath = f.Name(), u
+			case "display":
+				for _, s := range w.thumbs.displaySizes(r.image, id.Width, id.Height) {
+					if s == r.size {
+						dw, dh := displaySize(id.Width, id.Height, s)
+						id.Renditions = append(id.Renditions, rendition{Width: dw, Height: dh, Path: u})
+					}
 				}
 			}
 		}
 	}
-}
+	for _, id := range is {
+		sort.Slice(id.Renditions, func(i, j int) bool { return id.Renditions[i].Width < id.Renditions[j].Width })
+	}
+	if outdated {
+		log.Printf("Regenerating thumbs of album %#v with changed settings.", d)
+	}
+	if c := w.configs[d].Cover; c != "" && is[c] == nil && !reflect.DeepEqual(oldCfg, w.configs[d]) {
+		log.Printf("Cover %#v of album %#v not found, using first image.", c, d)
+	}
 
-var (
-	dirIndexTempl = `<!doctype html>
-<html>
-    <head>
-        <title>{{.Title}}</title>
-        <meta name="viewport" content="width=device-width, initial-scale=1.0">
-        <link href="https://fonts.googleapis.com/css?family=Raleway:100" rel="stylesheet">
-        <link rel="stylesheet" href="{{.URLPathPrefix}}/a/photoswipe.css">
-        <link rel="stylesheet" href="{{.URLPathPrefix}}/a/default-skin.css">
-        <script src="{{.URLPathPrefix}}/a/photoswipe.min.js"></script>
-        <script src="{{.URLPathPrefix}}/a/photoswipe-ui-default.min.js"></script>
-        <style>
-         body {
-             font-family: Roboto, sans-serif;
-             background-color: #000;
-             margin: 0;
-         }
-         h1 {
-             color: #fff;
-             margin: 0 0 20pt 0;
-             padding: 10pt 10pt 3pt 10pt;
-             text-align: right;
-             font-family: Raleway, sans-serif;
-         }
-         #gallery-overview figure {
-             margin: 0px;
-             max-width: 200px;
-         }
-         #gallery-overview figure a {
-             display: flex;
-         }
-         #gallery-overview figcaption {
-             font-size: 9pt;
-             font-weight: bold;
-             text-align: center;
-             display: none;
-         }
-         #gallery-overview {
-             display: flex;
-             flex-wrap: wrap;
-             justify-content: center;
-         }
-        </style>
-    </head>
-    <body>
-        <h1>{{.Title}}</h1>
-        <div class="pswp" tabindex="-1" role="dialog" aria-hidden="true">
-            <div class="pswp__bg"></div>
-            <div class="pswp__scroll-wrap">
-                <div class="pswp__container">
-                    <div class="pswp__item"></div>
-                    <div class="pswp__item"></div>
-                    <div class="pswp__item"></div>
-                </div>
-                <div class="pswp__ui pswp__ui--hidden">
-                    <div class="pswp__top-bar">
-                        <div class="pswp__counter"></div>
-                        <button class="pswp__button pswp__button--close" title="Close (Esc)"></button>
-                        <button class="pswp__button pswp__button--share" title="Share"></button>
-                        <button class="pswp__button pswp__button--fs" title="Toggle fullscreen"></button>
-                        <button class="pswp__button pswp__button--zoom" title="Zoom in/out"></button>
-                        <div class="pswp__preloader">
-                            <div class="pswp__preloader__icn">
-                                <div class="pswp__preloader__cut">
-                                    <div class="pswp__preloader__donut"></div>
-                                </div>
-                            </div>
-                        </div>
-                    </div>
-                    <div class="pswp__share-modal pswp__share-modal--hidden pswp__single-tap">
-                        <div class="pswp__share-tooltip"></div>
-                    </div>
-                    <button class="pswp__button pswp__button--arrow--left" title="Previous (arrow left)">
-                    </button>
-                    <button class="pswp__button pswp__button--arrow--right" title="Next (arrow right)">
-                    </button>
-                    <div class="pswp__caption">
-                        <div class="pswp__caption__center"></div>
-                    </div>
-                </div>
-            </div>
-        </div>
-        <div id="gallery-overview" class="gallery-overview">
-{{range .Images}}
-          <figure>
-            <a href="{{$.URLPathPrefix}}/{{.Path}}" data-size="{{.Width}}x{{.Height}}"><img src="{{$.URLPathPrefix}}/{{.ThumbPath}}" width="200" /></a>
-            <figcaption>{{.Caption}}&nbsp;</figcaption>
-          </figure>
-{{end}}
-        </div>
-        <script>
-         var parseThumbnailElements = function(el) {
-             var thumbElements = el.childNodes,
-                 numNodes = thumbElements.length,
-                 items = [],
-                 figureEl,
-                 linkEl,
-                 size,
-                 item;
-             for(var i = 0; i < numNodes; i++) {
-                 figureEl = thumbElements[i];
-                 if(figureEl.nodeType !== 1) {
-                     continue;
-                 }
-                 linkEl = figureEl.children[0];
-                 size = linkEl.getAttribute('data-size').split('x');
-                 item = {
-                     src: linkEl.getAttribute('href'),
-                     w: parseInt(size[0], 10),
-                     h: parseInt(size[1], 10)
-                 };
-                 if(figureEl.children.length > 1) {
-                     item.title = figureEl.children[1].innerHTML;
-                 }
-                 if(linkEl.children.length > 0) {
-                     item.msrc = linkEl.children[0].getAttribute('src');
-                 }
-                 item.el = figureEl;
-                 items.push(item);
-             }
-             return items;
-         };
-
-         // find nearest parent element
-         var closest = function closest(el, fn) {
-             return el && ( fn(el) ? el : closest(el.parentNode, fn) );
-         };
-
-         // triggers when user clicks on thumbnail
-         var onThumbnailsClick = function(e) {
-             e = e || window.event;
-             e.preventDefault ? e.preventDefault() : e.returnValue = false;
-             var eTarget = e.target || e.srcElement;
-             // find root element of slide
-             var clickedListItem = closest(eTarget, function(el) {
-                 return (el.tagName && el.tagName.toUpperCase() === 'FIGURE');
-             });
-             if(!clickedListItem) {
-                 return;
-             }
-
-             // find index of clicked item by looping through all child nodes
-             // alternatively, you may define index via data- attribute
-             var clickedGallery = clickedListItem.parentNode,
-                 childNodes = clickedListItem.parentNode.childNodes,
-                 numChildNodes = childNodes.length,
-                 nodeIndex = 0,
-                 index;
-             for (var i = 0; i < numChildNodes; i++) {
-                 if(childNodes[i].nodeType !== 1) {
-                     continue;
-                 }
-                 if(childNodes[i] === clickedListItem) {
-                     index = nodeIndex;
-                     break;
-                 }
-                 nodeIndex++;
-             }
-
-             if(index >= 0) {
-                 openPhotoSwipe( index, clickedGallery );
-             }
-             console.log("couldn't find a valid index, not opening");
-             return false;
-         };
-
-         // parse picture index and gallery index from URL (#&pid=1&gid=2)
-         var photoswipeParseHash = function() {
-             var hash = window.location.hash.substring(1),
-                 params = {};
-
-             if(hash.length < 5) {
-                 return params;
-             }
-
-             var vars = hash.split('&');
-             for (var i = 0; i < vars.length; i++) {
-                 if(!vars[i]) {
-                     continue;
-                 }
-                 var pair = vars[i].split('=');
-                 if(pair.length < 2) {
-                     continue;
-                 }
-                 params[pair[0]] = pair[1];
-             }
-
-             if(params.gid) {
-                 params.gid = parseInt(params.gid, 10);
-             }
-
-             return params;
-         };
-
-         var openPhotoSwipe = function(index, galleryElement, disableAnimation, fromURL) {
-             var pswpElement = document.querySelectorAll('.pswp')[0],
-                 gallery,
-                 options,
-                 items;
-             items = parseThumbnailElements(galleryElement);
-             options = {
-                 galleryUID: galleryElement.getAttribute('data-pswp-uid'),
-                 shareButtons: [
-                     {id:'download', label:'Download image', url:'{{"{{"}}raw_image_url{{"}}"}}', download:true}
-                 ],
-                 showHideOpacity: false,
-                 showAnimationDuration: 0,
-                 hideAnimationDuration: 0
-             };
-
-             if(fromURL) {
-                 if(options.galleryPIDs) {
-                     for(var j = 0; j < items.length; j++) {
-                         if(items[j].pid == index) {
-                             options.index = j;
-                             break;
-                         }
-                     }
-                 } else {
-                     options.index = parseInt(index, 10) - 1;
-                 }
-             } else {
-                 options.index = parseInt(index, 10);
-             }
-
-             // exit if index not found
-             if( isNaN(options.index) ) {
-                 console.log("couldn't find index in open")
-                 return;
-             }
-
-             if(disableAnimation) {
-                 options.showAnimationDuration = 0;
-             }
-
-             gallery = new PhotoSwipe( pswpElement, PhotoSwipeUI_Default, items, options);
-             gallery.init();
-         };
-
-         var initPhotoSwipeFromDOM = function(gallerySelector) {
-             var galleryElements = document.querySelectorAll( gallerySelector );
-             for(var i = 0, l = galleryElements.length; i < l; i++) {
-                 galleryElements[i].setAttribute('data-pswp-uid', i+1);
-                 galleryElements[i].onclick = onThumbnailsClick;
-             }
-         };
-         initPhotoSwipeFromDOM('.gallery-overview');
-        </script>
-    </body>
-</html>
-`
-)
+	cs.Removed = w.index.prune(d, is)
+	w.index.pruneGenerated(d, fs)
+	w.index.pruneChecked(d, append(append([]os.FileInfo{}, gfs...), rfs...))
+	w.collectGarbage(d, fs, rfs, is)
+
+	newCfg, hasCfg := w.configs[d]
+	changed := !cs.empty() || invalid || outdated || hadCfg != hasCfg || !reflect.DeepEqual(oldCfg, newCfg)
+	if _, known := w.images[d]; !known {
+		changed = true // first scan since start, thumbs may be missing
+	}
+
+	if len(is) == 0 {
+		delete(w.images, d)
+		return cs, changed
+	}
+	w.images[d] = is
+	return cs, changed
+}
@@ -0,0 +1,475 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"image/jpeg"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"sort"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestReloadAlbumSkipsInvalidThumbs(t *testing.T) {
+	dir := testDir(t)
+
+	ad := filepath.Join(dir, "kitties")
+	for _, n := range []string{"cat.jpg", "dog.jpg", "bird.jpg", "fish.jpg"} {
+		writeTestImage(t, filepath.Join(ad, n), 300, 200)
+	}
+	for _, n := range []string{"cat_thumb.jpg", "dog_thumb.jpg", "bird_thumb.jpg"} {
+		writeTestImage(t, filepath.Join(ad, n), 200, 200)
+	}
+
+	// truncated by an interrupted write
+	byts, err := ioutil.ReadFile(filepath.Join(ad, "dog_thumb.jpg"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := ioutil.WriteFile(filepath.Join(ad, "dog_thumb.jpg"), byts[:len(byts)/2], 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	// older than its original
+	old := time.Now().Add(-time.Hour)
+	if err := os.Chtimes(filepath.Join(ad, "bird_thumb.jpg"), old, old); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := ioutil.WriteFile(filepath.Join(ad, "fish_thumb.jpg"), nil, 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	w := newWatcher(config{BilderDir: dir, ThumbWorkers: 1}, nil)
+	w.reloadAlbum("kitties")
+
+	expected := map[string]string{"cat.jpg": "cat_thumb.jpg", "dog.jpg": "", "bird.jpg": "", "fish.jpg": ""}
+	for n, th := range expected {
+		id, ok := w.images["kitties"][n]
+		if !ok {
+			t.Errorf("Expected image %#v in album", n)
+			continue
+		}
+		if id.Thumb != th {
+			t.Errorf("Expected thumb %#v for %#v, got %#v", th, n, id.Thumb)
+		}
+	}
+
+	if _, changed := w.reloadAlbum("kitties"); !changed {
+		t.Errorf("Expected album with invalid thumbs to be considered changed, so that they're regenerated")
+	}
+}
+
+func TestReloadAlbumCollectsOrphanedThumbs(t *testing.T) {
+	dir := testDir(t)
+
+	ad, ld := filepath.Join(dir, "kitties"), filepath.Join(dir, "logos")
+	for _, n := range []string{"cat.jpg", "dog.jpg", "fish.jpg", "hen.jpg"} {
+		writeTestImage(t, filepath.Join(ad, n), 300, 200)
+	}
+	// thumbs generated by earlier versions, without records
+	writeTestImage(t, filepath.Join(ad, "cat_thumb.jpg"), 200, 200)
+	writeTestImage(t, filepath.Join(ad, "cat_thumb2x.jpg"), 400, 400)
+	writeTestImage(t, filepath.Join(ad, "hen_thumb.jpg"), 200, 200)
+	// photos named like thumbs
+	writeTestImage(t, filepath.Join(ad, "avatar_thumb.jpg"), 200, 200)
+	writeTestImage(t, filepath.Join(ad, "bird_thumb.jpg"), 300, 200)
+	writeTestImage(t, filepath.Join(ld, "logo_thumb.jpg"), 450, 200)
+	// a page that looks like those of earlier versions
+	if err := ioutil.WriteFile(filepath.Join(ad, "index.html"), []byte(`<div id="gallery-overview"></div>`), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if err := ioutil.WriteFile(filepath.Join(ld, "bilder.json"), []byte(`{"thumbs": {"aspect": "preserve"}}`), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	c := config{BilderDir: dir, ThumbWorkers: 1}
+	w := newWatcher(c, nil)
+	w.reloadContents()
+	for _, n := range []string{"dog.jpg", "fish.jpg"} {
+		r := thumbResult{album: "kitties", name: n, settings: w.thumbSettings("kitties")}
+		if err := w.thumbs.generateThumbs(&r); err != nil {
+			t.Fatal(err)
+		}
+		w.thumbGenerated(r)
+	}
+	w.index.save()
+
+	// replaced by the user after it was generated
+	writeTestImage(t, filepath.Join(ad, "fish_thumb.jpg"), 300, 200)
+	for _, n := range []string{"dog.jpg", "fish.jpg", "hen.jpg"} {
+		if err := os.Remove(filepath.Join(ad, n)); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	// generated and adopted files are recorded in the index
+	w = newWatcher(c, nil)
+	w.reloadContents()
+
+	for _, n := range []string{
+		"kitties/dog_thumb.jpg",
+		"kitties/hen_thumb.jpg",
+		"kitties/cat_thumb2x.jpg", // stored in the rendition directory now
+		renditionsDirName + "/kitties/dog_thumb2x.jpg",
+		renditionsDirName + "/kitties/fish_thumb2x.jpg",
+	} {
+		if _, err := os.Stat(filepath.Join(dir, n)); !os.IsNotExist(err) {
+			t.Errorf("Expected orphaned thumb %#v to be removed, err=%v", n, err)
+		}
+	}
+	for _, n := range []string{"kitties/cat_thumb.jpg", "kitties/avatar_thumb.jpg", "kitties/bird_thumb.jpg", "kitties/fish_thumb.jpg", "kitties/index.html", "logos/logo_thumb.jpg"} {
+		if _, err := os.Stat(filepath.Join(dir, n)); err != nil {
+			t.Errorf("Expected %#v to be kept, err=%v", n, err)
+		}
+	}
+
+	var actual []string
+	for _, d := range []string{"kitties", "logos"} {
+		for n := range w.images[d] {
+			actual = append(actual, d+"/"+n)
+		}
+	}
+	sort.Strings(actual)
+	expected := []string{"kitties/avatar_thumb.jpg", "kitties/bird_thumb.jpg", "kitties/cat.jpg", "kitties/fish_thumb.jpg", "logos/logo_thumb.jpg"}
+	if !reflect.DeepEqual(expected, actual) {
+		t.Errorf("Expected images %v, got %v", expected, actual)
+	}
+
+	var recorded []string
+	for k := range w.index.generated {
+		recorded = append(recorded, k)
+	}
+	if !reflect.DeepEqual([]string{"kitties/cat_thumb.jpg"}, recorded) {
+		t.Errorf("Expected only the thumb of cat.jpg to be recorded, got %v", recorded)
+	}
+}
+
+func TestCacheDirSkipsInPlaceThumbs(t *testing.T) {
+	dir := testDir(t)
+
+	bd, cd := filepath.Join(dir, "albums"), filepath.Join(dir, "cache")
+	writeTestImage(t, filepath.Join(bd, "kitties", "cat.jpg"), 300, 200)
+	writeTestImage(t, filepath.Join(bd, "kitties", "cat_thumb.jpg"), 200, 200)
+	writeTestImage(t, filepath.Join(bd, "kitties", "cat_thumb2x.jpg"), 400, 400)
+
+	w := newWatcher(config{BilderDir: bd, CacheDir: cd, ThumbWorkers: 1}, nil)
+	w.reloadContents()
+	if _, ok := w.images["kitties"]["cat.jpg"]; !ok || len(w.images["kitties"]) != 1 {
+		t.Errorf("Expected only cat.jpg in album, got %v", w.images["kitties"])
+	}
+	for _, n := range []string{"cat_thumb.jpg", "cat_thumb2x.jpg"} {
+		if _, err := os.Stat(filepath.Join(bd, "kitties", n)); err != nil {
+			t.Errorf("Expected %#v to be kept in the read-only album directory, err=%v", n, err)
+		}
+	}
+}
+
+func TestReloadAlbumCollectsCachedThumbs(t *testing.T) {
+	dir := testDir(t)
+
+	bd, cd := filepath.Join(dir, "albums"), filepath.Join(dir, "cache")
+	writeTestImage(t, filepath.Join(bd, "kitties", "cat.jpg"), 300, 200)
+	writeTestImage(t, filepath.Join(cd, "thumbs", "kitties", "cat_thumb.jpg"), 200, 200)
+	writeTestImage(t, filepath.Join(cd, "thumbs", "kitties", "dog_thumb.jpg"), 200, 200)
+	writeTestImage(t, filepath.Join(cd, "thumbs", "puppies", "dog_thumb.jpg"), 200, 200)
+
+	c := config{BilderDir: bd, CacheDir: cd, ThumbWorkers: 1, GCDryRun: true}
+	w := newWatcher(c, nil)
+	w.reloadContents()
+	for _, p := range []string{"kitties/dog_thumb.jpg", "puppies/dog_thumb.jpg"} {
+		if _, err := os.Stat(filepath.Join(cd, "thumbs", p)); err != nil {
+			t.Errorf("Expected %#v to be kept in dry-run mode, err=%v", p, err)
+		}
+	}
+	if w.gc.count != 2 {
+		t.Errorf("Expected 2 files to be reported, got %v", w.gc.count)
+	}
+
+	c.GCDryRun = false
+	w = newWatcher(c, nil)
+	w.reloadContents()
+	for _, p := range []string{"kitties/dog_thumb.jpg", "puppies"} {
+		if _, err := os.Stat(filepath.Join(cd, "thumbs", p)); !os.IsNotExist(err) {
+			t.Errorf("Expected %#v to be removed, err=%v", p, err)
+		}
+	}
+	if _, err := os.Stat(filepath.Join(cd, "thumbs", "kitties", "cat_thumb.jpg")); err != nil {
+		t.Errorf("Expected thumb of cat.jpg to be kept, err=%v", err)
+	}
+}
+
+func TestReloadAlbumRegeneratesThumbsWithChangedSettings(t *testing.T) {
+	dir := testDir(t)
+
+	ad := filepath.Join(dir, "kitties")
+	writeTestImage(t, filepath.Join(ad, "cat.jpg"), 300, 200)
+
+	w := newWatcher(config{BilderDir: dir, ThumbWorkers: 1}, nil)
+	w.reloadAlbum("kitties")
+	r := thumbResult{album: "kitties", name: "cat.jpg", settings: w.thumbSettings("kitties")}
+	if err := w.thumbs.generateThumbs(&r); err != nil {
+		t.Fatal(err)
+	}
+	w.thumbGenerated(r)
+
+	if _, changed := w.reloadAlbum("kitties"); changed {
+		t.Errorf("Expected album with up to date thumbs to be unchanged")
+	}
+	if id := w.images["kitties"]["cat.jpg"]; id.Thumb != "cat_thumb.jpg" || id.ThumbWidth != 200 || id.ThumbHeight != 200 {
+		t.Errorf("Expected 200x200 thumb cat_thumb.jpg, got %#v %vx%v", id.Thumb, id.ThumbWidth, id.ThumbHeight)
+	}
+
+	cfg := `{"thumbs": {"size": 100, "aspect": "preserve", "filter": "bilinear", "quality": 90, "progressive": true}}`
+	if err := ioutil.WriteFile(filepath.Join(ad, "bilder.json"), []byte(cfg), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if _, changed := w.reloadAlbum("kitties"); !changed {
+		t.Errorf("Expected album with changed thumb settings to be considered changed, so that they're regenerated")
+	}
+	id := w.images["kitties"]["cat.jpg"]
+	if id.Thumb != "" {
+		t.Errorf("Expected thumb generated with other settings to be skipped, got %#v", id.Thumb)
+	}
+	if id.ThumbWidth != 150 || id.ThumbHeight != 100 {
+		t.Errorf("Expected thumb dimensions 150x100, got %vx%v", id.ThumbWidth, id.ThumbHeight)
+	}
+
+	r = thumbResult{album: "kitties", name: "cat.jpg", settings: w.thumbSettings("kitties")}
+	if err := w.thumbs.generateThumbs(&r); err != nil {
+		t.Fatal(err)
+	}
+	w.thumbGenerated(r)
+	if _, changed := w.reloadAlbum("kitties"); changed {
+		t.Errorf("Expected album with regenerated thumbs to be unchanged")
+	}
+	if id := w.images["kitties"]["cat.jpg"]; id.Thumb != "cat_thumb.jpg" {
+		t.Errorf("Expected thumb cat_thumb.jpg, got %#v", id.Thumb)
+	}
+
+	for p, size := range map[string][2]int{
+		filepath.Join(ad, "cat_thumb.jpg"):                                  {150, 100},
+		filepath.Join(dir, renditionsDirName, "kitties", "cat_thumb2x.jpg"): {300, 200},
+	} {
+		byts, err := ioutil.ReadFile(p)
+		if err != nil {
+			t.Fatal(err)
+		}
+		ic, err := jpeg.DecodeConfig(bytes.NewReader(byts))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if ic.Width != size[0] || ic.Height != size[1] {
+			t.Errorf("Expected %#v to be %vx%v, got %vx%v", p, size[0], size[1], ic.Width, ic.Height)
+		}
+		if !bytes.Contains(byts, []byte{0xff, 0xc2}) {
+			t.Errorf("Expected %#v to be a progressive image", p)
+		}
+	}
+}
+
+func TestCoverKeepsPhotoNamedLikeCover(t *testing.T) {
+	dir := testDir(t)
+
+	ad := filepath.Join(dir, "books")
+	writeTestImage(t, filepath.Join(ad, "book.jpg"), 300, 200)
+	writeTestImage(t, filepath.Join(ad, "book_cover.jpg"), 200, 300) // a photo
+	photo, err := ioutil.ReadFile(filepath.Join(ad, "book_cover.jpg"))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	w := newWatcher(config{BilderDir: dir, ThumbWorkers: 1}, nil)
+	w.reloadAlbum("books")
+
+	cn, err := w.thumbs.generateCover("books", "book.jpg", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	w.thumbGenerated(thumbResult{album: "books", name: "book.jpg", cover: cn})
+	w.reloadAlbum("books")
+
+	byts, err := ioutil.ReadFile(filepath.Join(ad, "book_cover.jpg"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(byts) != string(photo) {
+		t.Errorf("Expected photo book_cover.jpg to be kept")
+	}
+	if _, ok := w.images["books"]["book_cover.jpg"]; !ok {
+		t.Errorf("Expected photo book_cover.jpg in album")
+	}
+	if id := w.images["books"]["book.jpg"]; id.CoverPath != "b/books/_thumbs/book_cover.jpg" {
+		t.Errorf("Expected cover of book.jpg below _thumbs, got %#v", id.CoverPath)
+	}
+	if _, err := os.Stat(filepath.Join(dir, renditionsDirName, "books", "book_cover.jpg")); err != nil {
+		t.Errorf("Expected cover in rendition directory, err=%v", err)
+	}
+}
+
+func TestCollectGarbageKeepsPosterInProgress(t *testing.T) {
+	dir := testDir(t)
+
+	bd, cd := filepath.Join(dir, "albums"), filepath.Join(dir, "cache")
+	writeTestImage(t, filepath.Join(dir, "frame.jpg"), 300, 200)
+	if err := os.MkdirAll(filepath.Join(bd, "kitties"), 0755); err != nil {
+		t.Fatal(err)
+	}
+	if err := ioutil.WriteFile(filepath.Join(bd, "kitties", "clip.mp4"), []byte("video"), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	// records the name of the file that ffmpeg writes to, which is the last
+	// argument.
+	ff := filepath.Join(dir, "ffmpeg")
+	script := "#!/bin/sh\nfor a; do out=$a; done\nbasename \"$out\" > " + filepath.Join(dir, "out") + "\ncp " + filepath.Join(dir, "frame.jpg") + " \"$out\"\n"
+	if err := ioutil.WriteFile(ff, []byte(script), 0755); err != nil {
+		t.Fatal(err)
+	}
+
+	c := config{BilderDir: bd, CacheDir: cd, ThumbWorkers: 1, FFmpeg: ff}
+	w := newWatcher(c, nil)
+	if _, err := w.thumbs.extractPoster("kitties", "clip.mp4"); err != nil {
+		t.Fatal(err)
+	}
+	byts, err := ioutil.ReadFile(filepath.Join(dir, "out"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	tn := strings.TrimSpace(string(byts))
+	if !tempFileRegexp.MatchString(tn) {
+		t.Fatalf("Expected poster to be extracted to a hidden temporary file, got %#v", tn)
+	}
+
+	// a poster that's still being extracted
+	tp := filepath.Join(cd, "thumbs", "kitties", tn)
+	writeTestImage(t, tp, 300, 200)
+	w.reloadContents()
+	if _, err := os.Stat(tp); err != nil {
+		t.Errorf("Expected poster in progress to be kept, err=%v", err)
+	}
+}
+
+func TestThumbSettingsMerge(t *testing.T) {
+	parse := func(cfg string) thumbSettings {
+		var dc dirConfig
+		if err := json.Unmarshal([]byte(cfg), &dc); err != nil {
+			t.Fatal(err)
+		}
+		return dc.Thumbs
+	}
+
+	parent := parse(`{"thumbs": {"size": 100, "Quality": 90, "progressive": true, "colour": "red"}}`)
+	if parent.unknown != "colour" {
+		t.Errorf("Expected unsupported keys to be recorded, got %#v", parent.unknown)
+	}
+
+	s := defaultThumbSettings.merge(parent)
+	if s.unknown != "" || s.key() != "100 square lanczos3 90 progressive" {
+		t.Errorf("Expected progressive settings without unsupported keys, got %#v with key %#v", s, s.key())
+	}
+	if sub := s.merge(parse(`{"thumbs": {"size": 120}}`)); !sub.Progressive {
+		t.Errorf("Expected progressive to be inherited, got %#v", sub)
+	}
+	if sub := s.merge(parse(`{"thumbs": {"progressive": false}}`)); sub.Progressive || sub.key() != "100 square lanczos3 90" {
+		t.Errorf("Expected album to turn off progressive, got %#v with key %#v", sub, sub.key())
+	}
+}
+
+func TestReloadAlbumRemembersCheckedThumbs(t *testing.T) {
+	dir := testDir(t)
+
+	ad := filepath.Join(dir, "kitties")
+	writeTestImage(t, filepath.Join(ad, "cat.jpg"), 300, 200)
+	c := config{BilderDir: dir, ThumbWorkers: 1}
+	w := newWatcher(c, nil)
+	w.reloadContents()
+	r := thumbResult{album: "kitties", name: "cat.jpg", settings: w.thumbSettings("kitties")}
+	if err := w.thumbs.generateThumbs(&r); err != nil {
+		t.Fatal(err)
+	}
+	w.thumbGenerated(r)
+	w.reloadContents()
+
+	// a thumb that changed without changing its size and modification time
+	// isn't decoded again after a restart
+	tp := filepath.Join(ad, "cat_thumb.jpg")
+	fi, err := os.Stat(tp)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := ioutil.WriteFile(tp, make([]byte, fi.Size()), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Chtimes(tp, fi.ModTime(), fi.ModTime()); err != nil {
+		t.Fatal(err)
+	}
+
+	w = newWatcher(c, nil)
+	w.reloadContents()
+	if id := w.images["kitties"]["cat.jpg"]; id.Thumb != "cat_thumb.jpg" {
+		t.Errorf("Expected checked thumb to be used without decoding it, got %#v", id.Thumb)
+	}
+
+	if err := os.Chtimes(tp, fi.ModTime(), fi.ModTime().Add(time.Second)); err != nil {
+		t.Fatal(err)
+	}
+	w.reloadContents()
+	if id := w.images["kitties"]["cat.jpg"]; id.Thumb != "" {
+		t.Errorf("Expected changed thumb to be checked again, got %#v", id.Thumb)
+	}
+}
+
+func TestAlbumDirsSkipReservedNames(t *testing.T) {
+	dir := testDir(t)
+
+	for _, d := range []string{"kitties", "kitties/r", "kitties/login", "kitties/logout", "kitties/_thumbs", "kitties/rr"} {
+		writeTestImage(t, filepath.Join(dir, filepath.FromSlash(d), "cat.jpg"), 300, 200)
+	}
+
+	w := newWatcher(config{BilderDir: dir, ThumbWorkers: 1}, nil)
+	actual := w.albumDirs("")
+	sort.Strings(actual)
+	if expected := []string{"kitties", "kitties/rr"}; !reflect.DeepEqual(expected, actual) {
+		t.Errorf("Expected albums %v, got %v", expected, actual)
+	}
+}
+
+func TestSortImages(t *testing.T) {
+	at := func(h int) time.Time { return time.Date(2018, 1, 1, h, 0, 0, 0, time.UTC) }
+	images := func() []*imgDetails {
+		return []*imgDetails{
+			{Path: "c.mp4", Type: "video", ModTime: at(2)},
+			{Path: "a.jpg", ModTime: at(3), Exif: exifDetails{Taken: at(1)}},
+			{Path: "d.jpg", ModTime: at(3), Exif: exifDetails{Taken: at(0)}},
+			{Path: "b.jpg", ModTime: at(1), Exif: exifDetails{Taken: at(2)}},
+		}
+	}
+
+	for _, tt := range []struct {
+		cfg      dirConfig
+		expected []string
+	}{
+		{dirConfig{}, []string{"a.jpg", "b.jpg", "c.mp4", "d.jpg"}},
+		{dirConfig{SortDirection: "desc"}, []string{"d.jpg", "c.mp4", "b.jpg", "a.jpg"}},
+		{dirConfig{SortOrder: "ModTime"}, []string{"a.jpg", "d.jpg", "c.mp4", "b.jpg"}},
+		{dirConfig{SortOrder: "ModTime", SortDirection: "asc"}, []string{"b.jpg", "c.mp4", "a.jpg", "d.jpg"}},
+		// videos fall back to their modification time, ties are sorted by name
+		{dirConfig{SortOrder: "Taken"}, []string{"d.jpg", "a.jpg", "b.jpg", "c.mp4"}},
+		{dirConfig{SortOrder: "Taken", SortDirection: "DESC"}, []string{"b.jpg", "c.mp4", "a.jpg", "d.jpg"}},
+	} {
+		ids := images()
+		sortImages(ids, tt.cfg)
+		var actual []string
+		for _, id := range ids {
+			actual = append(actual, id.Path)
+		}
+		if !reflect.DeepEqual(tt.expected, actual) {
+			t.Errorf("Sorting by %#v %#v: expected %v, got %v", tt.cfg.SortOrder, tt.cfg.SortDirection, tt.expected, actual)
+		}
+	}
+}